@@ -14,6 +14,7 @@ type App struct {
 	ctx        context.Context
 	cancel     context.CancelFunc
 	controller *controller.Controller
+	loader     controller.ConfigLoader
 }
 
 func NewApp() *App {
@@ -21,9 +22,15 @@ func NewApp() *App {
 		ctx:        nil,
 		cancel:     nil,
 		controller: nil,
+		loader:     nil,
 	}
 }
 
+//configuration is read again by loader on reload
+func (app *App) SetConfigLoader(loader controller.ConfigLoader) {
+	app.loader = loader
+}
+
 func (app *App) Run(serverConf *conf.ServerConfig, confDir string, httpAddr string) {
 	app.ctx, app.cancel = context.WithCancel(context.Background())
 	go func() {
@@ -35,6 +42,7 @@ func (app *App) Run(serverConf *conf.ServerConfig, confDir string, httpAddr stri
 	}()
 
 	app.controller = controller.NewController(serverConf, confDir)
+	app.controller.SetConfigLoader(app.loader)
 	go func() {
 		if err := app.controller.Run(httpAddr); nil != err {
 			logrus.Errorf("server run failed, err: %+v", err)
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"jingxi.cn/transitservice/conf"
+	"jingxi.cn/transitservice/controller"
+	"jingxi.cn/transitservice/opensips"
+	"jingxi.cn/transitservice/push"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+//exit codes of check-config, configuration errors take precedence over unreachable services
+const (
+	CheckOk          = 0
+	CheckInvalid     = 1
+	CheckUnreachable = 2
+)
+
+const checkTimeout = 5 * time.Second
+
+//problems of configuration file, sip.json and message.json found without connecting to anything
+func checkFiles(file string, serverConf *conf.ServerConfig, confDir string) []conf.Problem {
+	problems, err := conf.CheckKeys(file)
+	if err != nil {
+		problems = []conf.Problem{{Level: conf.ProblemError, Key: filepath.Base(file), Message: err.Error()}}
+	}
+	problems = append(problems, serverConf.Check(confDir)...)
+
+	data, err := ioutil.ReadFile(filepath.Join(confDir, "sip.json"))
+	if err == nil {
+		_, err = opensips.ParseSipIceTemplate(data)
+	}
+	if err != nil {
+		problems = append(problems, conf.Problem{Level: conf.ProblemError, Key: "sip.json", Message: err.Error()})
+	}
+	//keywords are loaded only when push is supported
+	if serverConf.IsSupportPush() {
+		if _, err = push.LoadKeywords(confDir, serverConf.Locale); err != nil {
+			problems = append(problems, conf.Problem{Level: conf.ProblemError, Key: "message.json", Message: err.Error()})
+		}
+	}
+	return problems
+}
+
+//any http response means the endpoint is reachable, credentials are not tried
+func pingUrl(url string) error {
+	client := &http.Client{Timeout: checkTimeout}
+	resp, err := client.Head(url)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+//check configuration, sip.json and message.json, connect mysql and push endpoints, and write a report to out
+//returns CheckOk, CheckInvalid or CheckUnreachable
+func CheckConfig(file string, loader controller.ConfigLoader, confDir string, out io.Writer) int {
+	serverConf, err := loader()
+	if err != nil {
+		fmt.Fprintf(out, "%-7s %s: %v\n", conf.ProblemError, filepath.Base(file), err)
+		return CheckInvalid
+	}
+	problems := checkFiles(file, serverConf, confDir)
+	errors, warnings := 0, 0
+	for _, v := range problems {
+		if v.Level == conf.ProblemError {
+			errors++
+		} else {
+			warnings++
+		}
+		fmt.Fprintln(out, v)
+	}
+
+	unreachable := 0
+	if db, err := opensips.InitDatabase(serverConf); err != nil {
+		unreachable++
+		fmt.Fprintf(out, "%-7s mysql: %v\n", "fail", err)
+	} else {
+		_ = db.Close()
+		fmt.Fprintf(out, "%-7s mysql: connected\n", "ok")
+	}
+	for _, v := range push.Endpoints(serverConf) {
+		if err := pingUrl(v.Url); err != nil {
+			unreachable++
+			fmt.Fprintf(out, "%-7s %s %s: %v\n", "fail", v.Provider, v.Url, err)
+		} else {
+			fmt.Fprintf(out, "%-7s %s %s: reachable\n", "ok", v.Provider, v.Url)
+		}
+	}
+	fmt.Fprintf(out, "%d errors, %d warnings, %d unreachable\n", errors, warnings, unreachable)
+
+	if errors > 0 {
+		return CheckInvalid
+	}
+	if unreachable > 0 {
+		return CheckUnreachable
+	}
+	return CheckOk
+}
+
+//log problems found without connecting to anything, server starts anyway
+func SelfCheck(file string, serverConf *conf.ServerConfig, confDir string) {
+	for _, v := range checkFiles(file, serverConf, confDir) {
+		if v.Level == conf.ProblemError {
+			logrus.Errorf("check config: %s", v)
+		} else {
+			logrus.Warnf("check config: %s", v)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package conf
+
+import (
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ProblemError   = "error"
+	ProblemWarning = "warning"
+)
+
+//configuration mistake found by check, key is the yaml path such as opensips.domain
+type Problem struct {
+	Level   string `json:"level"`
+	Key     string `json:"key"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%-7s %s: %s", p.Level, p.Key, p.Message)
+}
+
+//whether a required key of a push provider is set
+type presence struct {
+	name string
+	set  bool
+}
+
+//keys of the yaml file which no field of ServerConfig takes, or takes only because of case insensitive match
+func CheckKeys(file string) ([]Problem, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]interface{}
+	if err = yaml.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	problems := make([]Problem, 0)
+	checkKeys("", values, reflect.TypeOf(ServerConfig{}), &problems)
+	return problems, nil
+}
+
+func checkKeys(path string, value interface{}, t reflect.Type, problems *[]Problem) {
+	switch t.Kind() {
+	case reflect.Struct:
+		values, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			v := values[key]
+			name := joinKey(path, key)
+			field, found := fieldOfKey(t, key)
+			if !found {
+				*problems = append(*problems, Problem{ProblemError, name, "unknown key"})
+				continue
+			}
+			tag := field.Tag.Get("yaml")
+			if tag != key {
+				*problems = append(*problems, Problem{ProblemError, name, "key case differs from " + tag})
+			}
+			checkKeys(joinKey(path, tag), v, field.Type, problems)
+		}
+	case reflect.Slice:
+		values, ok := value.([]interface{})
+		if !ok {
+			return
+		}
+		for i, v := range values {
+			checkKeys(path+"["+strconv.Itoa(i)+"]", v, t.Elem(), problems)
+		}
+	}
+}
+
+func fieldOfKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if strings.EqualFold(t.Field(i).Tag.Get("yaml"), key) {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func joinKey(path string, key string) string {
+	if len(path) < 1 {
+		return key
+	}
+	return path + "." + key
+}
+
+//required fields, malformed values and half configured push providers
+//relative key files are looked up in confDir
+func (c *ServerConfig) Check(confDir string) []Problem {
+	problems := make([]Problem, 0)
+	add := func(level string, key string, format string, args ...interface{}) {
+		problems = append(problems, Problem{level, key, fmt.Sprintf(format, args...)})
+	}
+	required := func(key string, value string) {
+		if len(value) < 1 {
+			add(ProblemError, key, "required")
+		}
+	}
+	checkUrl := func(key string, value string) {
+		if len(value) < 1 {
+			return
+		}
+		if err := checkHttpUrl(value); err != nil {
+			add(ProblemError, key, "%v", err)
+		}
+	}
+	notNegative := func(key string, value int) {
+		if value < 0 {
+			add(ProblemError, key, "must not be negative")
+		}
+	}
+	keyFile := func(key string, file string) {
+		if len(file) < 1 {
+			return
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(confDir, file)
+		}
+		if _, err := os.Stat(file); err != nil {
+			add(ProblemError, key, "%v", err)
+		}
+	}
+	provider := func(section string, configured bool, supported bool, keys ...presence) {
+		if !configured || supported {
+			return
+		}
+		missing := make([]string, 0)
+		for _, v := range keys {
+			if !v.set {
+				missing = append(missing, v.name)
+			}
+		}
+		add(ProblemError, section, "provider disabled, missing %s", strings.Join(missing, ", "))
+	}
+
+	required("opensips.sipServer", c.Opensips.SipServer)
+	required("opensips.domain", c.Opensips.Domain)
+	switch strings.ToLower(c.Opensips.Backend) {
+	case "", BackendOpensips, BackendFreeswitch, BackendKamailio:
+	default:
+		add(ProblemError, "opensips.backend", "unknown backend %s", c.Opensips.Backend)
+	}
+	checkUrl("transit.url", c.Transit.Url)
+	checkUrl("transit.surl", c.Transit.SUrl)
+
+	required("mysql.url", c.Mysql.Url)
+	required("mysql.table", c.Mysql.Table)
+	if len(c.Mysql.Url) > 0 {
+		if _, err := mysql.ParseDSN(c.Mysql.Url); err != nil {
+			add(ProblemError, "mysql.url", "%v", err)
+		}
+	}
+	notNegative("mysql.maxOpenConns", c.Mysql.MaxOpenConns)
+	notNegative("mysql.maxIdleConns", c.Mysql.MaxIdleConns)
+	notNegative("mysql.connMaxLifeTime", c.Mysql.ConnMaxLifeTime)
+
+	checkUrl("push.sendAttachMsgUrl", c.Push.SendAttachMsgUrl)
+	checkUrl("push.sendBatchUrl", c.Push.SendBatchUrl)
+	provider("push", len(c.Push.SendAttachMsgUrl) > 0 || len(c.Push.AppAccid) > 0 ||
+		len(c.Push.AppKey) > 0 || len(c.Push.AppSecret) > 0, c.IsSupportYunxin(),
+		presence{"sendAttachMsgUrl", len(c.Push.SendAttachMsgUrl) > 0},
+		presence{"appAccid", len(c.Push.AppAccid) > 0},
+		presence{"appKey", len(c.Push.AppKey) > 0},
+		presence{"appSecret", len(c.Push.AppSecret) > 0},
+	)
+
+	checkUrl("apns.url", c.Apns.Url)
+	keyFile("apns.keyFile", c.Apns.KeyFile)
+	provider("apns", !reflect.ValueOf(c.Apns).IsZero(), c.IsSupportApns(),
+		presence{"keyFile", len(c.Apns.KeyFile) > 0},
+		presence{"keyId", len(c.Apns.KeyId) > 0},
+		presence{"teamId", len(c.Apns.TeamId) > 0},
+		presence{"topics", len(c.Apns.Topics) > 0},
+	)
+	for i, topic := range c.Apns.Topics {
+		key := fmt.Sprintf("apns.topics[%d]", i)
+		required(key+".topic", topic.Topic)
+		if topic.Priority != 0 && topic.Priority != 5 && topic.Priority != 10 {
+			add(ProblemError, key+".priority", "must be 5 or 10")
+		}
+		notNegative(key+".expiration", topic.Expiration)
+	}
+
+	checkUrl("fcm.url", c.Fcm.Url)
+	checkUrl("fcm.tokenUrl", c.Fcm.TokenUrl)
+	keyFile("fcm.keyFile", c.Fcm.KeyFile)
+	provider("fcm", !reflect.ValueOf(c.Fcm).IsZero(), c.IsSupportFcm(), presence{"keyFile", len(c.Fcm.KeyFile) > 0})
+
+	vendors := []struct {
+		section   string
+		push      VendorPush
+		supported bool
+		keys      []presence
+	}{
+		{"huawei", c.Huawei, c.IsSupportHuawei(), []presence{
+			{"appId", len(c.Huawei.AppId) > 0},
+			{"appSecret", len(c.Huawei.AppSecret) > 0},
+		}},
+		{"xiaomi", c.Xiaomi, c.IsSupportXiaomi(), []presence{
+			{"appSecret", len(c.Xiaomi.AppSecret) > 0},
+			{"package", len(c.Xiaomi.Package) > 0},
+		}},
+		{"oppo", c.Oppo, c.IsSupportOppo(), []presence{
+			{"appKey", len(c.Oppo.AppKey) > 0},
+			{"appSecret", len(c.Oppo.AppSecret) > 0},
+		}},
+		{"vivo", c.Vivo, c.IsSupportVivo(), []presence{
+			{"appId", len(c.Vivo.AppId) > 0},
+			{"appKey", len(c.Vivo.AppKey) > 0},
+			{"appSecret", len(c.Vivo.AppSecret) > 0},
+		}},
+	}
+	for _, v := range vendors {
+		checkUrl(v.section+".url", v.push.Url)
+		checkUrl(v.section+".authUrl", v.push.AuthUrl)
+		provider(v.section, !reflect.ValueOf(v.push).IsZero(), v.supported, v.keys...)
+	}
+	if !c.IsSupportPush() {
+		add(ProblemWarning, "push", "no push provider configured, /push is disabled")
+	}
+
+	notNegative("queue.workers", c.Queue.Workers)
+	notNegative("queue.maxAttempts", c.Queue.MaxAttempts)
+	notNegative("queue.baseDelay", c.Queue.BaseDelay)
+	notNegative("queue.maxDelay", c.Queue.MaxDelay)
+	notNegative("dedup.window", c.Dedup.Window)
+	for i, rule := range c.Ttl {
+		key := fmt.Sprintf("ttl[%d]", i)
+		notNegative(key+".ttl", rule.Ttl)
+		if len(rule.Action) > 0 && !strings.EqualFold(rule.Action, TtlActionDrop) &&
+			!strings.EqualFold(rule.Action, TtlActionMissed) {
+			add(ProblemError, key+".action", "must be %s or %s", TtlActionDrop, TtlActionMissed)
+		}
+	}
+	switch c.Dnd.Action {
+	case "", DndActionSuppress, DndActionSilent, DndActionDeliver:
+	default:
+		add(ProblemError, "dnd.action", "must be %s, %s or %s", DndActionSuppress, DndActionSilent, DndActionDeliver)
+	}
+	notNegative("broadcast.rate", c.Broadcast.Rate)
+	if !c.IsFreeswitchProtected() {
+		if c.Freeswitch.PlainPassword {
+			add(ProblemError, "freeswitch.plainPassword", "needs freeswitch.secret or freeswitch.allow")
+		}
+		if c.IsFreeswitch() {
+			add(ProblemWarning, "freeswitch", "no secret or allow list, /freeswitch/directory is refused")
+		}
+	}
+	for i, v := range c.Freeswitch.Allow {
+		if _, _, err := net.ParseCIDR(v); err != nil && net.ParseIP(v) == nil {
+			add(ProblemError, fmt.Sprintf("freeswitch.allow[%d]", i), "%s is not an ip or cidr", v)
+		}
+	}
+	checkUrl("kamailio.rpcUrl", c.Kamailio.RpcUrl)
+	if len(c.Admin.Users) < 1 {
+		add(ProblemWarning, "admin.users", "empty, management api is refused")
+	}
+	names := make(map[string]bool)
+	for i, v := range c.Admin.Users {
+		key := fmt.Sprintf("admin.users[%d]", i)
+		required(key+".name", v.Name)
+		required(key+".token", v.Token)
+		if names[v.Name] {
+			add(ProblemError, key+".name", "duplicate %s", v.Name)
+		}
+		names[v.Name] = true
+	}
+	if c.IsSupportPush() && len(c.TokenAuth.Secret) < 1 {
+		add(ProblemWarning, "tokenAuth.secret", "empty, push token api of apps is refused")
+	}
+	notNegative("reload.delay", c.Reload.Delay)
+	return problems
+}
+
+func checkHttpUrl(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme of %s is not http or https", value)
+	}
+	if len(u.Host) < 1 {
+		return fmt.Errorf("host of %s is empty", value)
+	}
+	return nil
+}
@@ -6,12 +6,21 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+const (
+	BackendOpensips   = "opensips"
+	BackendFreeswitch = "freeswitch"
+	BackendKamailio   = "kamailio"
 )
 
 type Opensips struct {
 	SipServer  string `yaml:"sipServer"`
 	StunServer string `yaml:"stunServer"`
 	Domain     string `yaml:"domain"`
+	Backend    string `yaml:"backend"` //opensips(default), freeswitch or kamailio, see Freeswitch
 }
 type Transit struct {
 	Url  string `yaml:"url"`
@@ -30,15 +39,194 @@ type Push struct {
 	AppSecret        string `yaml:"appSecret"`
 	AppAccid         string `yaml:"appAccid"`
 	SendAttachMsgUrl string `yaml:"sendAttachMsgUrl"`
+	SendBatchUrl     string `yaml:"sendBatchUrl"` //sendBatchAttachMsg, empty is derived from sendAttachMsgUrl
 	MsgTag           string `yaml:"msgTag"`
 	Save             string `yaml:"save"`
 }
 
+//APNs topic, selected by intercom scheme
+type ApnsTopic struct {
+	Topic      string `yaml:"topic"`      //bundle id, voip push uses <bundle id>.voip
+	Scheme     string `yaml:"scheme"`     //intercom scheme which uses this topic, empty is default
+	PushType   string `yaml:"pushType"`   //apns-push-type, default is alert
+	Priority   int    `yaml:"priority"`   //apns-priority, 10 or 5
+	Expiration int    `yaml:"expiration"` //seconds, 0 means deliver once
+}
+
+//APNs token based authentication
+type Apns struct {
+	Url     string      `yaml:"url"`     //https://api.push.apple.com or https://api.sandbox.push.apple.com
+	KeyFile string      `yaml:"keyFile"` //.p8 key, relative to conf directory
+	KeyId   string      `yaml:"keyId"`
+	TeamId  string      `yaml:"teamId"`
+	Topics  []ApnsTopic `yaml:"topics"`
+}
+
+//android channel and classification of an intercom message type, empty scheme or cmd matches any
+type PushChannel struct {
+	Scheme    string `yaml:"scheme"`
+	Cmd       string `yaml:"cmd"`
+	ChannelId string `yaml:"channelId"`
+	Priority  string `yaml:"priority"` //fcm HIGH or NORMAL, huawei urgency
+	Category  string `yaml:"category"` //vendor message category, e.g. VOIP, IM
+}
+
+//Firebase Cloud Messaging HTTP v1
+type Fcm struct {
+	Url       string        `yaml:"url"`       //https://fcm.googleapis.com
+	KeyFile   string        `yaml:"keyFile"`   //service account json key, relative to conf directory
+	ProjectId string        `yaml:"projectId"` //empty is project_id of service account
+	TokenUrl  string        `yaml:"tokenUrl"`  //empty is token_uri of service account
+	Channels  []PushChannel `yaml:"channels"`
+}
+
+//chinese android vendor push, empty url is the vendor default
+type VendorPush struct {
+	Url       string        `yaml:"url"`
+	AuthUrl   string        `yaml:"authUrl"`
+	AppId     string        `yaml:"appId"`
+	AppKey    string        `yaml:"appKey"`
+	AppSecret string        `yaml:"appSecret"` //oppo master secret
+	Package   string        `yaml:"package"`   //android package name
+	Channels  []PushChannel `yaml:"channels"`
+}
+
+//asynchronous push queue stored on disk
+type Queue struct {
+	Enable      bool   `yaml:"enable"`
+	Dir         string `yaml:"dir"`         //empty is <storage dir>/queue
+	Workers     int    `yaml:"workers"`     //default 4
+	MaxAttempts int    `yaml:"maxAttempts"` //default 5
+	BaseDelay   int    `yaml:"baseDelay"`   //milliseconds of the first retry, default 1000
+	MaxDelay    int    `yaml:"maxDelay"`    //milliseconds, default 60000
+}
+
+const (
+	TtlActionDrop   = "drop"
+	TtlActionMissed = "missed"
+)
+
+//time-to-live of intercom message since its CreateTime, selected by scheme and cmd like push channels
+type TtlRule struct {
+	Scheme      string `yaml:"scheme"` //empty matches any scheme
+	Cmd         string `yaml:"cmd"`    //empty matches any cmd
+	Ttl         int    `yaml:"ttl"`    //seconds, 0 never expires
+	Action      string `yaml:"action"` //drop or missed, default drop
+	MissedTitle string `yaml:"missedTitle"`
+	MissedBody  string `yaml:"missedBody"`
+	MissedCmd   string `yaml:"missedCmd"` //cmd of missed call notification, empty keeps cmd
+}
+
+const (
+	DndActionSuppress = "suppress"
+	DndActionSilent   = "silent"
+	DndActionDeliver  = "deliver"
+)
+
+//do-not-disturb of residents
+type Dnd struct {
+	Action string `yaml:"action"` //push in quiet time: suppress, silent or deliver, default silent
+}
+
+//notification text locales, message.<locale>.json in conf directory
+type Locale struct {
+	Default  string              `yaml:"default"`  //locale used when recipient locale has no file, empty is message.json
+	Fallback map[string][]string `yaml:"fallback"` //locale to the locales tried before its language and default
+}
+
+//push deduplication, door stations retry /push on timeout
+type Dedup struct {
+	Window int `yaml:"window"` //seconds a push is remembered, 0 is disabled
+}
+
+//community broadcast
+type Broadcast struct {
+	Rate int `yaml:"rate"` //pushes per second, default 50
+}
+
+//SIP phone auto provisioning, digest auth enabled when username not empty
+type Provision struct {
+	Dir      string `yaml:"dir"` //template directory, relative to conf directory
+	Realm    string `yaml:"realm"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+//FreeSWITCH mod_xml_curl directory, answered from the subscriber table register writes
+//FreeSWITCH has no subscriber table, backend freeswitch only changes the sip identity host to domain
+//the directory answers credentials, so it is refused unless secret or allow is set
+type Freeswitch struct {
+	Context       string   `yaml:"context"`       //user_context variable, default is "default"
+	PlainPassword bool     `yaml:"plainPassword"` //answer password param instead of a1-hash
+	Secret        string   `yaml:"secret"`        //basic auth password of mod_xml_curl gateway-credentials
+	Allow         []string `yaml:"allow"`         //ip or cidr of FreeSWITCH servers
+}
+
+//Kamailio subscriber table and jsonrpcs, empty column is kamailio default
+type Kamailio struct {
+	Realm          string `yaml:"realm"` //auth realm of ha1, empty is domain
+	PasswordColumn string `yaml:"passwordColumn"`
+	Ha1Column      string `yaml:"ha1Column"`
+	Ha1bColumn     string `yaml:"ha1bColumn"`
+	RpcUrl         string `yaml:"rpcUrl"`        //jsonrpcs over xhttp, http://127.0.0.1:5060/RPC
+	LocationTable  string `yaml:"locationTable"` //usrloc table, default is location
+	UseDomain      bool   `yaml:"useDomain"`     //usrloc use_domain, aor is user@domain
+}
+
+//local json stores such as device registry
+type Storage struct {
+	Dir string `yaml:"dir"`
+}
+
+//reload when files of conf directory change, /reload works either way
+type Reload struct {
+	Watch bool `yaml:"watch"`
+	Delay int  `yaml:"delay"` //milliseconds to wait for more changes, default 500
+}
+
+//push token api of app installs requires Authorization: Bearer <expire>.<signature>
+//signature is hex hmac-sha256 of "<userId>\n<fid>\n<expire>" by secret, expire is unix seconds
+//the app account backend shares secret and issues the credential to a signed-in resident
+//the api is refused when secret is empty
+type TokenAuth struct {
+	Secret string `yaml:"secret"`
+}
+
+//account of management api such as push tokens, keywords and sip template
+type AdminUser struct {
+	Name  string `yaml:"name"` //recorded as author of revisions
+	Token string `yaml:"token"`
+}
+
+//management api requires Authorization: Bearer <token> of a user, it is refused when users is empty
+type Admin struct {
+	Users []AdminUser `yaml:"users"`
+}
+
 type ServerConfig struct {
-	Opensips Opensips `yaml:"opensips"`
-	Transit  Transit  `yaml:"transit"`
-	Mysql    Mysql    `yaml:"mysql"`
-	Push     Push     `yaml:"push"`
+	Opensips   Opensips   `yaml:"opensips"`
+	Transit    Transit    `yaml:"transit"`
+	Mysql      Mysql      `yaml:"mysql"`
+	Push       Push       `yaml:"push"`
+	Apns       Apns       `yaml:"apns"`
+	Fcm        Fcm        `yaml:"fcm"`
+	Huawei     VendorPush `yaml:"huawei"`
+	Xiaomi     VendorPush `yaml:"xiaomi"`
+	Oppo       VendorPush `yaml:"oppo"`
+	Vivo       VendorPush `yaml:"vivo"`
+	Queue      Queue      `yaml:"queue"`
+	Dedup      Dedup      `yaml:"dedup"`
+	Ttl        []TtlRule  `yaml:"ttl"`
+	Dnd        Dnd        `yaml:"dnd"`
+	Locale     Locale     `yaml:"locale"`
+	Broadcast  Broadcast  `yaml:"broadcast"`
+	Provision  Provision  `yaml:"provision"`
+	Freeswitch Freeswitch `yaml:"freeswitch"`
+	Kamailio   Kamailio   `yaml:"kamailio"`
+	Storage    Storage    `yaml:"storage"`
+	Reload     Reload     `yaml:"reload"`
+	Admin      Admin      `yaml:"admin"`
+	TokenAuth  TokenAuth  `yaml:"tokenAuth"`
 }
 
 func LoadServerConfig(file string) (*ServerConfig, error) {
@@ -56,6 +244,18 @@ func LoadServerConfig(file string) (*ServerConfig, error) {
 	return &c, nil
 }
 
+//yaml names of sections which differ between c and other
+func (c *ServerConfig) ChangedSections(other *ServerConfig) []string {
+	sections := make([]string, 0)
+	a, b := reflect.ValueOf(c).Elem(), reflect.ValueOf(other).Elem()
+	for i := 0; i < a.NumField(); i++ {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			sections = append(sections, a.Type().Field(i).Tag.Get("yaml"))
+		}
+	}
+	return sections
+}
+
 func (c *ServerConfig) WriteConfigToFile(file string) error {
 	data, err := json.MarshalIndent(c, "", "\t")
 	if err != nil {
@@ -69,8 +269,53 @@ func (c *ServerConfig) WriteConfigToFile(file string) error {
 }
 
 func (c *ServerConfig) IsSupportPush() bool {
+	return c.IsSupportYunxin() || c.IsSupportApns() || c.IsSupportFcm() ||
+		c.IsSupportHuawei() || c.IsSupportXiaomi() || c.IsSupportOppo() || c.IsSupportVivo()
+}
+
+func (c *ServerConfig) IsSupportYunxin() bool {
 	return len(c.Push.SendAttachMsgUrl) > 0 &&
 		len(c.Push.AppAccid) > 0 &&
 		len(c.Push.AppKey) > 0 &&
 		len(c.Push.AppSecret) > 0
 }
+
+func (c *ServerConfig) IsFreeswitch() bool {
+	return strings.EqualFold(c.Opensips.Backend, BackendFreeswitch)
+}
+
+func (c *ServerConfig) IsKamailio() bool {
+	return strings.EqualFold(c.Opensips.Backend, BackendKamailio)
+}
+
+//freeswitch directory is served only behind secret or allow list
+func (c *ServerConfig) IsFreeswitchProtected() bool {
+	return len(c.Freeswitch.Secret) > 0 || len(c.Freeswitch.Allow) > 0
+}
+
+func (c *ServerConfig) IsSupportApns() bool {
+	return len(c.Apns.KeyFile) > 0 &&
+		len(c.Apns.KeyId) > 0 &&
+		len(c.Apns.TeamId) > 0 &&
+		len(c.Apns.Topics) > 0
+}
+
+func (c *ServerConfig) IsSupportFcm() bool {
+	return len(c.Fcm.KeyFile) > 0
+}
+
+func (c *ServerConfig) IsSupportHuawei() bool {
+	return len(c.Huawei.AppId) > 0 && len(c.Huawei.AppSecret) > 0
+}
+
+func (c *ServerConfig) IsSupportXiaomi() bool {
+	return len(c.Xiaomi.AppSecret) > 0 && len(c.Xiaomi.Package) > 0
+}
+
+func (c *ServerConfig) IsSupportOppo() bool {
+	return len(c.Oppo.AppKey) > 0 && len(c.Oppo.AppSecret) > 0
+}
+
+func (c *ServerConfig) IsSupportVivo() bool {
+	return len(c.Vivo.AppId) > 0 && len(c.Vivo.AppKey) > 0 && len(c.Vivo.AppSecret) > 0
+}
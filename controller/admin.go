@@ -0,0 +1,37 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+//name of authenticated admin user kept in gin context
+const adminUserKey = "adminUser"
+
+//middleware of management api, Authorization: Bearer <token> of a configured admin user
+func (c *Controller) adminHandlerFunc(ctx *gin.Context) {
+	auth := ctx.GetHeader("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		token := []byte(strings.TrimSpace(auth[7:]))
+		for _, v := range c.config().Admin.Users {
+			if len(v.Token) > 0 && subtle.ConstantTimeCompare(token, []byte(v.Token)) == 1 {
+				ctx.Set(adminUserKey, v.Name)
+				return
+			}
+		}
+	}
+	logrus.Errorf("%s %s unauthorized from %s", ctx.Request.Method, ctx.Request.URL.Path, ctx.Request.RemoteAddr)
+	ctx.Header("WWW-Authenticate", `Bearer realm="admin"`)
+	ctx.AbortWithStatusJSON(http.StatusUnauthorized, Result{
+		Status:  http.StatusUnauthorized,
+		Message: "Unauthorized",
+	})
+}
+
+//authenticated admin user of request
+func adminUser(ctx *gin.Context) string {
+	return ctx.GetString(adminUserKey)
+}
@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"jingxi.cn/transitservice/push"
+	"net/http"
+)
+
+func (c *Controller) checkBroadcastService(ctx *gin.Context) bool {
+	if c.broadcast == nil {
+		ctx.JSON(http.StatusServiceUnavailable, Result{
+			Status:  http.StatusServiceUnavailable,
+			Message: "Unsupported handler",
+		})
+		return false
+	}
+	return true
+}
+
+//schedule broadcast, it is sent at sendTime or now if sendTime is empty
+func (c *Controller) createBroadcastHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/broadcast called")
+	if !c.checkBroadcastService(ctx) {
+		return
+	}
+	var b push.Broadcast
+	if err := ctx.ShouldBindJSON(&b); err != nil {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: "Content empty or Content format invalid",
+		})
+		return
+	}
+	if err := c.broadcast.Create(&b); err != nil {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, c.broadcast.Get(b.Id))
+}
+
+func (c *Controller) listBroadcastHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/broadcast list called")
+	if !c.checkBroadcastService(ctx) {
+		return
+	}
+	ctx.JSON(http.StatusOK, c.broadcast.List())
+}
+
+//status, progress and delivery statistics of broadcast
+func (c *Controller) getBroadcastHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/broadcast/%s called", ctx.Param("id"))
+	if !c.checkBroadcastService(ctx) {
+		return
+	}
+	b := c.broadcast.Get(ctx.Param("id"))
+	if b == nil {
+		ctx.JSON(http.StatusNotFound, Result{
+			Status:  http.StatusNotFound,
+			Message: "broadcast not found",
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, b)
+}
+
+func (c *Controller) cancelBroadcastHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/broadcast/%s cancel called", ctx.Param("id"))
+	if !c.checkBroadcastService(ctx) {
+		return
+	}
+	if err := c.broadcast.Cancel(ctx.Param("id")); err != nil {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, c.broadcast.Get(ctx.Param("id")))
+}
@@ -2,15 +2,21 @@ package controller
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"github.com/fsnotify/fsnotify"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"jingxi.cn/transitservice/conf"
 	"jingxi.cn/transitservice/opensips"
+	"jingxi.cn/transitservice/provision"
 	"jingxi.cn/transitservice/push"
+	"jingxi.cn/transitservice/registry"
+	"net"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -31,10 +37,23 @@ type Controller struct {
 	sipConf    []byte //sip.json bytebuffer
 	confDir    string //conf directory
 	proxyConf  ProxyConf
-	subscriber *opensips.SubService //opensips subscriber service
-	push       *push.PushService    //push to Yunxin
-	srv        *http.Server         //http service
-	keyword    *push.Keyword        //push message text replace
+	subscriber *opensips.SubService     //opensips subscriber service
+	push       *push.PushService        //push to Yunxin
+	srv        *http.Server             //http service
+	keyword    *push.Keywords           //push message text replace of each locale
+	provAuth   *provision.DigestAuth    //digest auth of phone provisioning, nil is disabled
+	devices    *registry.DeviceRegistry //devices registered sip account
+	tokens     *registry.TokenRegistry  //push tokens of mobile app installs
+	queue      *push.PushQueue          //asynchronous push, nil is disabled
+	letters    *push.DeadLetterStore    //dead letters of failed pushes
+	broadcast  *push.BroadcastService   //community broadcast
+	dedup      *Deduplicator            //duplicate /push, nil is disabled
+	dnd        *registry.DndRegistry    //do-not-disturb schedules of residents
+	wording    *push.KeywordStore       //revisions of keyword files edited by admin api
+	sipStore   *opensips.TemplateStore  //revisions of sip.json edited by admin api
+	loader     ConfigLoader             //reads configuration again on reload, nil keeps it
+	watcher    *fsnotify.Watcher        //conf directory watch, nil is disabled
+	reloading  sync.Mutex               //serializes Reload with admin api saves of sip.json and keyword files
 	rw         sync.RWMutex
 }
 
@@ -46,6 +65,18 @@ func NewController(conf *conf.ServerConfig, confDir string) *Controller {
 		push:       nil,
 		srv:        nil,
 		keyword:    nil,
+		provAuth:   nil,
+		devices:    nil,
+		tokens:     nil,
+		queue:      nil,
+		letters:    nil,
+		broadcast:  nil,
+		dedup:      nil,
+		dnd:        nil,
+		wording:    nil,
+		sipStore:   nil,
+		loader:     nil,
+		watcher:    nil,
 	}
 }
 
@@ -54,30 +85,110 @@ func (c *Controller) loadConfig() error {
 	if err != nil {
 		return err
 	}
-	sipConf.ReplaceSipServer(c.serverConf.Opensips.SipServer)
-	sipConf.ReplaceStunServer(c.serverConf.Opensips.StunServer)
+	if err = c.applySipTemplate(sipConf); err != nil {
+		return err
+	}
+	c.sipStore = opensips.NewTemplateStore(filepath.Join(c.confDir, "sip.json"),
+		filepath.Join(c.storageDir(), "sip"))
+
+	c.subscriber = opensips.NewSubService(c.serverConf)
 
-	c.sipConf, err = json.Marshal(sipConf)
+	c.devices, err = registry.LoadDeviceRegistry(filepath.Join(c.storageDir(), "devices.json"))
 	if err != nil {
 		return err
 	}
 
-	c.subscriber = opensips.NewSubService(c.serverConf)
+	c.tokens, err = registry.LoadTokenRegistry(filepath.Join(c.storageDir(), "tokens.json"))
+	if err != nil {
+		return err
+	}
+
+	c.dnd, err = registry.LoadDndRegistry(filepath.Join(c.storageDir(), "dnd.json"))
+	if err != nil {
+		return err
+	}
 
 	if c.serverConf.IsSupportPush() {
-		c.keyword, err = push.LoadKeyword(filepath.Join(c.confDir, "message.json"))
+		c.wording = push.NewKeywordStore(filepath.Join(c.storageDir(), "keywords"), c.confDir, c.serverConf.Locale)
+		if _, err = c.wording.Sync(); err != nil {
+			return err
+		}
+		c.keyword, err = push.LoadKeywords(c.confDir, c.serverConf.Locale)
+		if err != nil {
+			return err
+		}
+		c.push, err = push.NewPushService(c.serverConf, c.confDir)
+		if err != nil {
+			return err
+		}
+		c.push.SetTokenRegistry(c.tokens)
+		c.push.SetDndRegistry(c.dnd)
+		c.letters, err = push.LoadDeadLetterStore(filepath.Join(c.storageDir(), "deadletter"))
 		if err != nil {
 			return err
 		}
-		c.push = push.NewPushService(c.serverConf)
+		if c.serverConf.Queue.Enable {
+			dir := c.serverConf.Queue.Dir
+			if len(dir) < 1 {
+				dir = filepath.Join(c.storageDir(), "queue")
+			}
+			c.queue, err = push.NewPushQueue(c.serverConf.Queue, dir, c.push)
+			if err != nil {
+				return err
+			}
+			c.queue.SetFailedHandler(c.addDeadLetter)
+		}
+		c.broadcast, err = push.LoadBroadcastService(c.serverConf.Broadcast,
+			filepath.Join(c.storageDir(), "broadcasts.json"), c.push, c.devices)
+		if err != nil {
+			return err
+		}
+		//broadcast messages get the same keyword, derive and locale rules as /push
+		c.broadcast.SetPreparer(func(message *push.IntercomMessage) {
+			c.replaceIntercomMessage(message)
+		})
+		if c.queue != nil {
+			c.broadcast.SetQueue(c.queue)
+			c.queue.SetFinishedHandler(c.broadcast.JobFinished)
+		}
 	}
-	c.proxyConf = ProxyConf{
-		Url:  c.serverConf.Transit.Url,
-		SUrl: c.serverConf.Transit.SUrl,
+	c.dedup = newDeduplicator(c.serverConf)
+	c.provAuth = newProvisionAuth(c.serverConf)
+	c.proxyConf = newProxyConf(c.serverConf)
+	return nil
+}
+
+//nil if dedup window is 0
+func newDeduplicator(serverConf *conf.ServerConfig) *Deduplicator {
+	if serverConf.Dedup.Window > 0 {
+		return NewDeduplicator(time.Duration(serverConf.Dedup.Window) * time.Second)
 	}
 	return nil
 }
 
+//nil if provisioning is not protected
+func newProvisionAuth(serverConf *conf.ServerConfig) *provision.DigestAuth {
+	if len(serverConf.Provision.Username) > 0 {
+		return provision.NewDigestAuth(serverConf.Provision.Realm,
+			serverConf.Provision.Username, serverConf.Provision.Password)
+	}
+	return nil
+}
+
+func newProxyConf(serverConf *conf.ServerConfig) ProxyConf {
+	return ProxyConf{
+		Url:  serverConf.Transit.Url,
+		SUrl: serverConf.Transit.SUrl,
+	}
+}
+
+func (c *Controller) storageDir() string {
+	if len(c.serverConf.Storage.Dir) > 0 {
+		return c.serverConf.Storage.Dir
+	}
+	return filepath.Join(c.confDir, "data")
+}
+
 func NoResponse(c *gin.Context) {
 	c.JSON(http.StatusNotFound, gin.H{
 		"status": 404,
@@ -91,12 +202,68 @@ func (c *Controller) Run(httpAddr string) error {
 		return err
 	}
 
+	if c.queue != nil {
+		c.queue.Start()
+	}
+	if c.broadcast != nil {
+		c.broadcast.Start()
+	}
+	if c.serverConf.Reload.Watch {
+		if err = c.watchConfig(); err != nil {
+			logrus.Errorf("watch %s error: %+v", c.confDir, err)
+		}
+	}
+
 	router := gin.Default()
 
 	router.GET("/keepalive", c.keepAliveHandlerFunc)
-	router.POST("/push", c.pushHandlerFunc)
+
+	//management api
+	admin := router.Group("", c.adminHandlerFunc)
+	admin.GET("/push/token", c.listTokenHandlerFunc)
+	admin.GET("/push/deadletter", c.listDeadLetterHandlerFunc)
+	admin.DELETE("/push/deadletter", c.purgeDeadLetterHandlerFunc)
+	admin.GET("/push/deadletter/:id", c.inspectDeadLetterHandlerFunc)
+	admin.DELETE("/push/deadletter/:id", c.deleteDeadLetterHandlerFunc)
+	admin.POST("/push/deadletter/:id/replay", c.replayDeadLetterHandlerFunc)
+	admin.POST("/push/broadcast", c.createBroadcastHandlerFunc)
+	admin.GET("/push/broadcast", c.listBroadcastHandlerFunc)
+	admin.GET("/push/broadcast/:id", c.getBroadcastHandlerFunc)
+	admin.DELETE("/push/broadcast/:id", c.cancelBroadcastHandlerFunc)
+	admin.GET("/push/dnd", c.listDndHandlerFunc)
+	admin.POST("/push/dnd", c.saveDndHandlerFunc)
+	admin.GET("/push/dnd/:id", c.getDndHandlerFunc)
+	admin.PUT("/push/dnd/:id", c.saveDndHandlerFunc)
+	admin.DELETE("/push/dnd/:id", c.deleteDndHandlerFunc)
+	admin.POST("/push/keyword/test", c.testKeywordHandlerFunc)
+	admin.POST("/push/keyword/validate", c.validateKeywordHandlerFunc)
+	admin.GET("/push/keyword", c.listKeywordHandlerFunc)
+	admin.GET("/push/keyword/:locale", c.getKeywordHandlerFunc)
+	admin.PUT("/push/keyword/:locale", c.saveKeywordHandlerFunc)
+	admin.GET("/push/keyword/:locale/revision", c.listKeywordRevisionHandlerFunc)
+	admin.GET("/push/keyword/:locale/revision/:id", c.getKeywordRevisionHandlerFunc)
+	admin.GET("/push/keyword/:locale/diff", c.diffKeywordHandlerFunc)
+	admin.POST("/push/keyword/:locale/rollback", c.rollbackKeywordHandlerFunc)
+	admin.GET("/opensip/v2/template", c.getSipTemplateHandlerFunc)
+	admin.PUT("/opensip/v2/template", c.saveSipTemplateHandlerFunc)
+	admin.POST("/opensip/v2/template/validate", c.validateSipTemplateHandlerFunc)
+	admin.GET("/opensip/v2/template/revision", c.listSipTemplateRevisionHandlerFunc)
+	admin.GET("/opensip/v2/template/revision/:id", c.getSipTemplateRevisionHandlerFunc)
+	admin.POST("/opensip/v2/template/rollback", c.rollbackSipTemplateHandlerFunc)
+	admin.GET("/opensip/v2/template/preview", c.previewSipTemplateHandlerFunc)
+	admin.POST("/opensip/v2/template/preview", c.previewSipTemplateHandlerFunc)
+	admin.POST("/reload", c.reloadHandlerFunc)
+
+	router.POST("/push", c.dedupHandlerFunc, c.pushHandlerFunc)
+	//app installs, authorized by credential of the resident
+	router.POST("/push/token/register", c.registerTokenHandlerFunc)
+	router.POST("/push/token/refresh", c.refreshTokenHandlerFunc)
+	router.POST("/push/token/unregister", c.unregisterTokenHandlerFunc)
 	router.POST("/opensip/v2/register", c.registerHandlerFunc)
-	router.GET("/reload", c.reloadHandlerFunc)
+	router.GET("/opensip/v2/provisioning", c.provisioningHandlerFunc)
+	router.POST("/opensip/v2/provisioning", c.registerHandlerFunc)
+	router.GET("/provision/:file", c.provisionHandlerFunc)
+	router.POST("/freeswitch/directory", c.freeswitchAuthHandlerFunc, c.freeswitchDirectoryHandlerFunc)
 	router.NoRoute(NoResponse)
 
 	c.srv = &http.Server{
@@ -110,7 +277,7 @@ func (c *Controller) Run(httpAddr string) error {
 		return err
 	}
 
-	return c.subscriber.Close()
+	return c.subService().Close()
 }
 
 func (c *Controller) Stop() {
@@ -123,6 +290,15 @@ func (c *Controller) Stop() {
 	if err := c.srv.Shutdown(ctx); err != nil {
 		logrus.Errorf("gin Shutdown error: %+v", err)
 	}
+	if c.watcher != nil {
+		_ = c.watcher.Close()
+	}
+	if c.broadcast != nil {
+		c.broadcast.Stop()
+	}
+	if c.queue != nil {
+		c.queue.Stop()
+	}
 }
 
 func (c *Controller) keepAliveHandlerFunc(ctx *gin.Context) {
@@ -133,12 +309,16 @@ func (c *Controller) keepAliveHandlerFunc(ctx *gin.Context) {
 		query.WriteString(fmt.Sprintf("%v=%v\n", key, values))
 	}
 	logrus.Infof("%s", query.String())
-	ctx.JSON(http.StatusOK, c.proxyConf)
+	c.rw.RLock()
+	proxyConf := c.proxyConf
+	c.rw.RUnlock()
+	ctx.JSON(http.StatusOK, proxyConf)
 }
 
 func (c *Controller) pushHandlerFunc(ctx *gin.Context) {
 	logrus.Infof("/push called")
-	if c.push == nil {
+	pushService := c.pushService()
+	if pushService == nil {
 		ctx.JSON(http.StatusServiceUnavailable, Result{
 			Status:  http.StatusServiceUnavailable,
 			Message: "Unsupported handler",
@@ -154,55 +334,73 @@ func (c *Controller) pushHandlerFunc(ctx *gin.Context) {
 		})
 		return
 	}
-	//replace title and body
-	c.replaceIntercomMessage(&message)
-
-	data, err := c.push.Push(&message)
+	messages, err := pushService.Resolve(&message)
 	if err != nil {
-		logrus.Errorf("push to yunxin error: %+v", err)
-		ctx.JSON(http.StatusServiceUnavailable, Result{
-			Status:  http.StatusServiceUnavailable,
-			Message: string(data),
+		ctx.JSON(http.StatusNotFound, Result{
+			Status:  http.StatusNotFound,
+			Message: err.Error(),
 		})
 		return
 	}
-	//https://doc.yunxin.163.com/messaging/docs/jYxMjQ1NTk?platform=server
-	//code: 414,403,500
-	type PushResult struct {
-		Code int    `json:"code"`
-		Desc string `json:"desc"`
+	//replace title and body in the locale of each recipient
+	for _, m := range messages {
+		c.replaceIntercomMessage(m)
 	}
-	var pushResult PushResult
-	err = json.Unmarshal(data, &pushResult)
+	if c.queue != nil && !isSyncPush(ctx) {
+		c.enqueueMessages(ctx, messages)
+		return
+	}
+	if message.IsFanOut() {
+		c.pushMessages(ctx, messages)
+		return
+	}
+
+	result, err := pushService.Push(&message)
+	c.checkDeadLetter(&message, result, err)
 	if err != nil {
-		logrus.Errorf("push to yunxin error: %+v", err)
 		ctx.JSON(http.StatusServiceUnavailable, Result{
 			Status:  http.StatusServiceUnavailable,
-			Message: string(data),
+			Message: err.Error(),
 		})
 		return
 	}
-	if pushResult.Code != 200 {
-		logrus.Errorf("push to yunxin error code:%d", pushResult.Code)
+	if result.Suppressed || result.Dropped {
+		ctx.JSON(http.StatusOK, Result{
+			Status:  http.StatusOK,
+			Message: result.Reason,
+		})
+		return
+	}
+	if !result.Success {
+		logrus.Errorf("push to %s error code:%d %s", result.Provider, result.Code, result.Reason)
 		ctx.JSON(http.StatusServiceUnavailable, Result{
-			Status:  pushResult.Code,
-			Message: string(data),
+			Status:  result.Code,
+			Message: result.Raw,
 		})
 		return
 	}
-	logrus.Infof("push to yunxin success: %s", string(data))
-	ctx.String(http.StatusOK, string(data))
+	logrus.Infof("push to %s success: %s", result.Provider, result.Raw)
+	ctx.String(http.StatusOK, result.Raw)
 }
 
-func (c *Controller) registerHandlerFunc(ctx *gin.Context) {
-	logrus.Infof("/v2/register called")
-	data := ctx.PostForm("data")
+//register data is posted as form, linphone provisioning fetches it by GET query
+//query string ends up in access logs, so GET carries no password
+func requestData(ctx *gin.Context) string {
+	if ctx.Request.Method == http.MethodGet {
+		return ctx.Query("data")
+	}
+	return ctx.PostForm("data")
+}
+
+//device request of register and provisioning, false if an error was answered
+func parseUserRequest(ctx *gin.Context) (*opensips.UserRequest, bool) {
+	data := requestData(ctx)
 	if len(data) < 1 {
 		ctx.JSON(http.StatusBadRequest, Result{
 			Status:  http.StatusBadRequest,
 			Message: "PostForm(data) empty",
 		})
-		return
+		return nil, false
 	}
 	var r opensips.UserRequest
 	err := json.Unmarshal([]byte(data), &r)
@@ -211,82 +409,279 @@ func (c *Controller) registerHandlerFunc(ctx *gin.Context) {
 			Status:  http.StatusBadRequest,
 			Message: "Invalid JSON format",
 		})
-		return
+		return nil, false
 	}
-	username := r.User
+	return &r, true
+}
 
-	if len(username) < 1 {
-		username = opensips.CreateUserId(r.Did, r.Client.ClientId, r.Client.SerialNumber)
+func (c *Controller) registerHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("%s called", ctx.FullPath())
+	r, ok := parseUserRequest(ctx)
+	if !ok {
+		return
+	}
+	user, result := c.ensureSubscriber(r)
+	if result != nil {
+		ctx.JSON(result.Status, *result)
+		return
 	}
-	user := opensips.NewUser(c.serverConf.Opensips.Domain, username, r.Pwd)
+	if err := c.devices.Update(registry.NewDevice(user.Username, r)); err != nil {
+		//the subscriber is registered, device variables of freeswitch directory are stale until next register
+		logrus.Errorf("update device %s error: %+v", user.Username, err)
+	}
+	c.createRegisterResponse(ctx, user)
+}
 
-	db_user, err, ok := c.subscriber.GetUser(username)
+//GET of linphone remote provisioning, answers an existing subscriber only and never writes it
+//password is taken from Authorization: Basic only, ?data= without user names the basic auth user
+func (c *Controller) provisioningHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/opensip/v2/provisioning called")
+	username, password, hasAuth := ctx.Request.BasicAuth()
+	r := &opensips.UserRequest{User: username}
+	if len(requestData(ctx)) > 0 {
+		var ok bool
+		if r, ok = parseUserRequest(ctx); !ok {
+			return
+		}
+	}
+	if len(r.Pwd) > 0 {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: "Password in query string not accepted, use Authorization header",
+		})
+		return
+	}
+	if !hasAuth || (len(r.User) > 0 && r.User != username) {
+		ctx.Header("WWW-Authenticate", `Basic realm="provisioning"`)
+		ctx.JSON(http.StatusUnauthorized, Result{
+			Status:  http.StatusUnauthorized,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	r.Pwd = password
+	user, err, ok := c.subService().GetUser(requestUsername(r))
 	if err != nil && !ok {
-		//database operation failed
 		ctx.JSON(http.StatusInternalServerError, Result{
 			Status:  http.StatusInternalServerError,
 			Message: "Database operation failed When Query User",
 		})
 		return
 	}
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, Result{
+			Status:  http.StatusNotFound,
+			Message: "User not found, register by POST first",
+		})
+		return
+	}
+	if !strings.EqualFold(user.Password, r.Pwd) {
+		ctx.JSON(http.StatusForbidden, Result{
+			Status:  http.StatusForbidden,
+			Message: "Password mismatch",
+		})
+		return
+	}
+	c.createRegisterResponse(ctx, user)
+}
+
+//user of request, or the one derived from device and client ids
+func requestUsername(r *opensips.UserRequest) string {
+	if len(r.User) > 0 {
+		return r.User
+	}
+	return opensips.CreateUserId(r.Did, r.Client.ClientId, r.Client.SerialNumber)
+}
+
+//add or update the subscriber of device request, return the valid user
+func (c *Controller) ensureSubscriber(r *opensips.UserRequest) (*opensips.User, *Result) {
+	username := requestUsername(r)
+	subscriber := c.subService()
+	user := opensips.NewUser(c.config().Opensips.Domain, username, r.Pwd)
+	if realm := subscriber.Realm(); len(realm) > 0 {
+		user.SetRealm(realm)
+	}
+
+	db_user, err, ok := subscriber.GetUser(username)
+	if err != nil && !ok {
+		//database operation failed
+		return nil, &Result{
+			Status:  http.StatusInternalServerError,
+			Message: "Database operation failed When Query User",
+		}
+	}
 	if err != nil {
 		//user does not exist,add it
-		err = c.subscriber.AddUser(user)
+		err = subscriber.AddUser(user)
 		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, Result{
+			return nil, &Result{
 				Status:  http.StatusInternalServerError,
 				Message: "Database operation failed When Add User",
-			})
-			return
+			}
 		}
-		c.createRegisterResponse(ctx, user)
-		return
+		return user, nil
 	}
-	if !opensips.IsUserValid(db_user, c.serverConf.Opensips.Domain) ||
+	if !opensips.IsUserValid(db_user, c.config().Opensips.Domain, subscriber.HashColumns()) ||
 		!strings.EqualFold(db_user.Password, user.Password) {
 		//user in database not valid or password dismatch,so we update
 		//for P2P device use fixed username and password
-		err = c.subscriber.UpdateUser(user)
+		err = subscriber.UpdateUser(user)
 		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, Result{
+			return nil, &Result{
 				Status:  http.StatusInternalServerError,
 				Message: "Database operation failed When update User",
-			})
-			return
+			}
 		}
-		c.createRegisterResponse(ctx, user)
-		return
+		return user, nil
 	}
 
 	//user existed and user valid
-	c.createRegisterResponse(ctx, db_user)
+	return db_user, nil
 }
 
+//reload configuration, sip.json and keyword files, reports the changed sections
 func (c *Controller) reloadHandlerFunc(ctx *gin.Context) {
 	logrus.Infof("/reload called")
-	keyword, err := push.LoadKeyword(filepath.Join(c.confDir, "message.json"))
+	changed, restart, err := c.Reload()
 	if err != nil {
-		msg := fmt.Sprintf("open %s failed", filepath.Join(c.confDir, "message.json"))
 		ctx.JSON(http.StatusInternalServerError, Result{
 			Status:  http.StatusInternalServerError,
-			Message: msg,
+			Message: err.Error(),
 		})
 		return
 	}
-	c.rw.Lock()
-	c.keyword = keyword
-	c.rw.Unlock()
-
-	ctx.JSON(http.StatusOK, Result{
+	ctx.JSON(http.StatusOK, ReloadResponse{
 		Status:  http.StatusOK,
 		Message: "success",
+		Changed: changed,
+		Restart: restart,
 	})
 }
 
-func (c *Controller) createRegisterResponse(ctx *gin.Context, user *opensips.User) {
+//sip.json template with servers of configuration filled in
+func buildSipConf(serverConf *conf.ServerConfig, sipConf *opensips.SipIceConfig) ([]byte, error) {
+	sipConf.ReplaceSipServer(serverConf.Opensips.SipServer)
+	sipConf.ReplaceStunServer(serverConf.Opensips.StunServer)
+	return json.Marshal(sipConf)
+}
+
+//fill servers in sip.json template and swap it in
+func (c *Controller) applySipTemplate(sipConf *opensips.SipIceConfig) error {
+	data, err := buildSipConf(c.config(), sipConf)
+	if err != nil {
+		return err
+	}
+	c.rw.Lock()
+	c.sipConf = data
+	c.rw.Unlock()
+	return nil
+}
+
+//sip.json template filled with user credentials
+func (c *Controller) createSipIceConfig(user *opensips.User) (*opensips.SipIceConfig, error) {
+	c.rw.RLock()
+	sipConf := c.sipConf
+	c.rw.RUnlock()
 	//for deep copy
 	var o opensips.SipIceConfig
-	err := json.Unmarshal(c.sipConf, &o)
+	err := json.Unmarshal(sipConf, &o)
+	if err != nil {
+		return nil, err
+	}
+	o.ReplaceUser(c.identityHost(), user.Username, user.Password)
+	return &o, nil
+}
+
+//opensips identity is user@sipserver, freeswitch directory is looked up by user@domain
+func (c *Controller) identityHost() string {
+	serverConf := c.config()
+	if serverConf.IsFreeswitch() && len(serverConf.Opensips.Domain) > 0 {
+		return serverConf.Opensips.Domain
+	}
+	return serverConf.Opensips.SipServer
+}
+
+//?format=linphone or Accept: application/xml selects linphone provisioning xml, ?format=json or Accept: application/json selects json
+//linphone sends neither, so /opensip/v2/provisioning answers xml by default
+func isLinphoneFormat(ctx *gin.Context) bool {
+	format := ctx.Query("format")
+	if len(format) > 0 {
+		return strings.EqualFold(format, "linphone") || strings.EqualFold(format, "xml")
+	}
+	accept := strings.ToLower(ctx.GetHeader("Accept"))
+	if strings.Contains(accept, "application/xml") || strings.Contains(accept, "text/xml") {
+		return true
+	}
+	if strings.Contains(accept, "application/json") {
+		return false
+	}
+	return ctx.FullPath() == "/opensip/v2/provisioning"
+}
+
+func (c *Controller) createRegisterResponse(ctx *gin.Context, user *opensips.User) {
+	o, err := c.createSipIceConfig(user)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, Result{
+			Status:  http.StatusInternalServerError,
+			Message: "Unmarshal failed",
+		})
+		return
+	}
+	c.writeSipIceConfig(ctx, o)
+}
+
+//json, or linphone xml if requested
+func (c *Controller) writeSipIceConfig(ctx *gin.Context, o *opensips.SipIceConfig) {
+	if !isLinphoneFormat(ctx) {
+		ctx.JSON(http.StatusOK, o)
+		return
+	}
+	data, err := o.LinphoneConfig(c.config().Opensips.Domain).Marshal()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, Result{
+			Status:  http.StatusInternalServerError,
+			Message: "Marshal linphone config failed",
+		})
+		return
+	}
+	ctx.Data(http.StatusOK, "application/xml; charset=utf-8", data)
+}
+
+//Yealink <mac>.cfg and Grandstream cfg<mac>.xml, the subscriber username is the mac
+func (c *Controller) provisionHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/provision called: %s", ctx.Param("file"))
+	c.rw.RLock()
+	provAuth := c.provAuth
+	c.rw.RUnlock()
+	if provAuth != nil && !provAuth.Check(ctx.Request) {
+		ctx.Header("WWW-Authenticate", provAuth.Challenge())
+		ctx.JSON(http.StatusUnauthorized, Result{
+			Status:  http.StatusUnauthorized,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	r, err := provision.ParseFileName(ctx.Param("file"), ctx.GetHeader("User-Agent"))
+	if err != nil {
+		NoResponse(ctx)
+		return
+	}
+	user, err, ok := c.subService().GetUser(r.Mac)
+	if err != nil && !ok {
+		ctx.JSON(http.StatusInternalServerError, Result{
+			Status:  http.StatusInternalServerError,
+			Message: "Database operation failed When Query User",
+		})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, Result{
+			Status:  http.StatusNotFound,
+			Message: "User not found",
+		})
+		return
+	}
+	o, err := c.createSipIceConfig(user)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, Result{
 			Status:  http.StatusInternalServerError,
@@ -294,12 +689,182 @@ func (c *Controller) createRegisterResponse(ctx *gin.Context, user *opensips.Use
 		})
 		return
 	}
-	o.ReplaceUser(c.serverConf.Opensips.SipServer, user.Username, user.Password)
-	ctx.JSON(http.StatusOK, o)
+	dir := c.config().Provision.Dir
+	if len(dir) < 1 {
+		dir = "provision"
+	}
+	t, err := provision.LoadTemplate(filepath.Join(c.confDir, dir), r)
+	if err != nil {
+		logrus.Errorf("load %s template error: %+v", r.Vendor, err)
+		ctx.JSON(http.StatusInternalServerError, Result{
+			Status:  http.StatusInternalServerError,
+			Message: "Load template failed",
+		})
+		return
+	}
+	data, err := provision.Render(t, c.createProvisionAccount(r, user, o))
+	if err != nil {
+		logrus.Errorf("render %s template error: %+v", r.Vendor, err)
+		ctx.JSON(http.StatusInternalServerError, Result{
+			Status:  http.StatusInternalServerError,
+			Message: "Render template failed",
+		})
+		return
+	}
+	ctx.Data(http.StatusOK, provision.ContentType(r.Vendor), data)
+}
+
+func (c *Controller) createProvisionAccount(r *provision.Request, user *opensips.User, o *opensips.SipIceConfig) *provision.Account {
+	serverConf := c.config()
+	host, port, err := net.SplitHostPort(serverConf.Opensips.SipServer)
+	if err != nil {
+		host = serverConf.Opensips.SipServer
+		port = "5060"
+	}
+	account := &provision.Account{
+		Mac:         r.Mac,
+		Model:       r.Model,
+		Username:    user.Username,
+		Password:    user.Password,
+		DisplayName: user.Username,
+		Domain:      serverConf.Opensips.Domain,
+		SipHost:     host,
+		SipPort:     port,
+		Transport:   strings.ToLower(o.Sip.Transport),
+		StunServer:  o.Ice.StunServer,
+		TurnServer:  o.Ice.TurnServer,
+	}
+	if len(o.Sip.Proxy) > 0 {
+		account.Expires = o.Sip.Proxy[0].Expires
+	}
+	return account
+}
+
+//whether ip is one of the ips or in one of the cidrs of list
+func isAllowed(list []string, ip net.IP) bool {
+	for _, v := range list {
+		if _, network, err := net.ParseCIDR(v); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if allowed := net.ParseIP(v); allowed != nil && allowed.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//middleware of /freeswitch/directory, the peer must be in allow list or send secret by basic auth
+//the directory answers credentials, it is refused when neither is configured
+func (c *Controller) freeswitchAuthHandlerFunc(ctx *gin.Context) {
+	serverConf := c.config()
+	if !serverConf.IsFreeswitchProtected() {
+		logrus.Errorf("/freeswitch/directory refused, set freeswitch.secret or freeswitch.allow")
+		ctx.AbortWithStatusJSON(http.StatusForbidden, Result{
+			Status:  http.StatusForbidden,
+			Message: "Forbidden",
+		})
+		return
+	}
+	//RemoteAddr, X-Forwarded-For could be forged
+	host, _, err := net.SplitHostPort(ctx.Request.RemoteAddr)
+	if err == nil && isAllowed(serverConf.Freeswitch.Allow, net.ParseIP(host)) {
+		return
+	}
+	if secret := serverConf.Freeswitch.Secret; len(secret) > 0 {
+		_, password, ok := ctx.Request.BasicAuth()
+		if ok && subtle.ConstantTimeCompare([]byte(password), []byte(secret)) == 1 {
+			return
+		}
+	}
+	ctx.Header("WWW-Authenticate", `Basic realm="freeswitch"`)
+	ctx.AbortWithStatusJSON(http.StatusUnauthorized, Result{
+		Status:  http.StatusUnauthorized,
+		Message: "Unauthorized",
+	})
+}
+
+//FreeSWITCH mod_xml_curl directory binding
+func (c *Controller) freeswitchDirectoryHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/freeswitch/directory called")
+	section := ctx.PostForm("section")
+	username := ctx.PostForm("user")
+	domain := ctx.PostForm("domain")
+	if section != "directory" || len(username) < 1 {
+		c.freeswitchResponse(ctx, opensips.NewFreeswitchNotFound())
+		return
+	}
+	if len(domain) < 1 {
+		domain = c.config().Opensips.Domain
+	}
+	user, err, ok := c.subService().GetUser(username)
+	if err != nil && !ok {
+		//FreeSWITCH treats non 200 as binding failure and tries next one
+		ctx.String(http.StatusInternalServerError, "Database operation failed When Query User")
+		return
+	}
+	if err != nil {
+		c.freeswitchResponse(ctx, opensips.NewFreeswitchNotFound())
+		return
+	}
+	c.freeswitchResponse(ctx, opensips.NewFreeswitchDirectory(domain, user,
+		c.config().Freeswitch.PlainPassword, c.freeswitchVariables(user)))
 }
 
-func (c *Controller) replaceIntercomMessage(message *push.IntercomMessage) {
+//user variables, device info comes from device registry
+func (c *Controller) freeswitchVariables(user *opensips.User) []opensips.FreeswitchParam {
+	userContext := c.config().Freeswitch.Context
+	if len(userContext) < 1 {
+		userContext = "default"
+	}
+	variables := []opensips.FreeswitchParam{
+		{Name: "user_context", Value: userContext},
+	}
+	device := c.devices.Get(user.Username)
+	if device == nil {
+		return variables
+	}
+	callerName := device.AliasName
+	if len(callerName) < 1 {
+		callerName = user.Username
+	}
+	callerNumber := device.Number
+	if len(callerNumber) < 1 {
+		callerNumber = user.Username
+	}
+	return append(variables,
+		opensips.FreeswitchParam{Name: "effective_caller_id_name", Value: callerName},
+		opensips.FreeswitchParam{Name: "effective_caller_id_number", Value: callerNumber},
+		opensips.FreeswitchParam{Name: "device_id", Value: device.Did},
+		opensips.FreeswitchParam{Name: "client_id", Value: device.ClientId},
+		opensips.FreeswitchParam{Name: "family_id", Value: device.FamilyId},
+		opensips.FreeswitchParam{Name: "device_type", Value: strconv.Itoa(device.Type)},
+		opensips.FreeswitchParam{Name: "device_platform", Value: strconv.Itoa(device.Platform)})
+}
+
+func (c *Controller) freeswitchResponse(ctx *gin.Context, doc *opensips.FreeswitchDocument) {
+	data, err := doc.Marshal()
+	if err != nil {
+		ctx.String(http.StatusInternalServerError, "Marshal freeswitch document failed")
+		return
+	}
+	ctx.Data(http.StatusOK, "text/xml; charset=utf-8", data)
+}
+
+func (c *Controller) replaceIntercomMessage(message *push.IntercomMessage) *push.KeywordRule {
 	c.rw.Lock()
 	defer c.rw.Unlock()
-	c.keyword.Replace(message)
+	var device *registry.Device
+	if c.devices != nil {
+		device = c.devices.FindByClientId(message.Cid)
+	}
+	if len(message.Locale) < 1 && len(message.Device) > 0 && c.tokens != nil {
+		tokens := c.tokens.Find(func(t *registry.PushToken) bool {
+			return t.Token == message.Device
+		})
+		if len(tokens) > 0 {
+			message.Locale = tokens[0].Locale
+		}
+	}
+	return c.keyword.Replace(message, device)
 }
@@ -0,0 +1,178 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"jingxi.cn/transitservice/push"
+	"net/http"
+	"strconv"
+)
+
+//keep failed push job as dead letter
+func (c *Controller) addDeadLetter(job *push.Job) {
+	if c.letters == nil {
+		return
+	}
+	_ = c.letters.Add(job, c.pushService().Render(&job.Message))
+}
+
+//synchronous push failed permanently, retries would not help
+//without queue a provider not reached is kept as well, nothing else retries it
+func (c *Controller) checkDeadLetter(message *push.IntercomMessage, result *push.DeliveryResult, err error) {
+	if err != nil {
+		if c.queue != nil {
+			return
+		}
+	} else if result.Success || result.Retryable || result.Dropped || result.Suppressed {
+		return
+	}
+	job := push.NewJob("", message)
+	job.AddAttempt(result, err)
+	c.addDeadLetter(job)
+}
+
+func deadLetterFilter(ctx *gin.Context) push.DeadLetterFilter {
+	code, _ := strconv.Atoi(ctx.Query("code"))
+	return push.DeadLetterFilter{
+		Device: ctx.Query("device"),
+		Fid:    ctx.Query("fid"),
+		Code:   code,
+	}
+}
+
+func (c *Controller) checkDeadLetterStore(ctx *gin.Context) bool {
+	if c.letters == nil {
+		ctx.JSON(http.StatusServiceUnavailable, Result{
+			Status:  http.StatusServiceUnavailable,
+			Message: "Unsupported handler",
+		})
+		return false
+	}
+	return true
+}
+
+func (c *Controller) getDeadLetter(ctx *gin.Context) *push.DeadLetter {
+	letter := c.letters.Get(ctx.Param("id"))
+	if letter == nil {
+		ctx.JSON(http.StatusNotFound, Result{
+			Status:  http.StatusNotFound,
+			Message: "dead letter not found",
+		})
+	}
+	return letter
+}
+
+func (c *Controller) listDeadLetterHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/deadletter called")
+	if !c.checkDeadLetterStore(ctx) {
+		return
+	}
+	ctx.JSON(http.StatusOK, c.letters.List(deadLetterFilter(ctx)))
+}
+
+func (c *Controller) inspectDeadLetterHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/deadletter/%s called", ctx.Param("id"))
+	if !c.checkDeadLetterStore(ctx) {
+		return
+	}
+	if letter := c.getDeadLetter(ctx); letter != nil {
+		ctx.JSON(http.StatusOK, letter)
+	}
+}
+
+//push dead letter again, it is removed once queued or delivered
+func (c *Controller) replayDeadLetterHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/deadletter/%s/replay called", ctx.Param("id"))
+	if !c.checkDeadLetterStore(ctx) {
+		return
+	}
+	letter := c.getDeadLetter(ctx)
+	if letter == nil {
+		return
+	}
+	message := letter.Message
+	if c.queue != nil && !isSyncPush(ctx) {
+		messageId, jobs, err := c.queue.Enqueue([]*push.IntercomMessage{&message})
+		if err != nil {
+			ctx.JSON(http.StatusServiceUnavailable, Result{
+				Status:  http.StatusServiceUnavailable,
+				Message: err.Error(),
+			})
+			return
+		}
+		_ = c.letters.Remove(letter.Id)
+		ctx.JSON(http.StatusAccepted, QueueResponse{
+			Status:    http.StatusAccepted,
+			Message:   "queued",
+			MessageId: messageId,
+			Jobs:      jobs,
+		})
+		return
+	}
+	result, err := c.pushService().Push(&message)
+	if err != nil || !result.Success {
+		//failed replay is kept in attempts of the letter
+		if e := c.letters.AddAttempt(letter.Id, result, err); e != nil {
+			logrus.Errorf("record replay of dead letter(%s) error: %+v", letter.Id, e)
+		}
+	}
+	if err != nil {
+		ctx.JSON(http.StatusServiceUnavailable, Result{
+			Status:  http.StatusServiceUnavailable,
+			Message: err.Error(),
+		})
+		return
+	}
+	status := http.StatusServiceUnavailable
+	if result.Success {
+		status = http.StatusOK
+		_ = c.letters.Remove(letter.Id)
+	}
+	ctx.JSON(status, result)
+}
+
+func (c *Controller) deleteDeadLetterHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/deadletter/%s delete called", ctx.Param("id"))
+	if !c.checkDeadLetterStore(ctx) {
+		return
+	}
+	if err := c.letters.Remove(ctx.Param("id")); err != nil {
+		ctx.JSON(http.StatusInternalServerError, Result{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, Result{
+		Status:  http.StatusOK,
+		Message: "success",
+	})
+}
+
+//remove all dead letters matched device, fid and code query, ?all=1 is required without any of them
+func (c *Controller) purgeDeadLetterHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/deadletter purge called")
+	if !c.checkDeadLetterStore(ctx) {
+		return
+	}
+	filter := deadLetterFilter(ctx)
+	if filter == (push.DeadLetterFilter{}) && ctx.Query("all") != "1" {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: "device, fid or code required, or all=1 to purge every dead letter",
+		})
+		return
+	}
+	count, err := c.letters.Purge(filter)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, Result{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, Result{
+		Status:  http.StatusOK,
+		Message: strconv.Itoa(count) + " purged",
+	})
+}
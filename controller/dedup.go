@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"jingxi.cn/transitservice/push"
+	"jingxi.cn/transitservice/utils"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	dedupWaitTimeout         = 30 * time.Second
+)
+
+//response of the first push, replayed to duplicates
+type dedupEntry struct {
+	cached      bool //response is 2xx, failed push is not remembered so the client can retry
+	status      int
+	contentType string
+	body        []byte
+	expire      time.Time
+	done        chan struct{} //closed when response recorded
+}
+
+//remembers /push responses for a window
+type Deduplicator struct {
+	window    time.Duration
+	entries   map[string]*dedupEntry
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+func NewDeduplicator(window time.Duration) *Deduplicator {
+	return &Deduplicator{
+		window:  window,
+		entries: make(map[string]*dedupEntry),
+	}
+}
+
+//entry of key, created is false if key was seen in window
+func (d *Deduplicator) acquire(key string) (*dedupEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if now.Sub(d.lastSweep) > d.window {
+		for k, v := range d.entries {
+			if isDone(v) && now.After(v.expire) {
+				delete(d.entries, k)
+			}
+		}
+		d.lastSweep = now
+	}
+	if v, ok := d.entries[key]; ok && (!isDone(v) || now.Before(v.expire)) {
+		return v, false
+	}
+	entry := &dedupEntry{done: make(chan struct{})}
+	d.entries[key] = entry
+	return entry, true
+}
+
+//only 2xx responses are remembered, entry of a failed push is removed
+func (d *Deduplicator) record(key string, entry *dedupEntry, status int, contentType string, body []byte) {
+	d.mu.Lock()
+	if status >= http.StatusOK && status < http.StatusMultipleChoices {
+		entry.cached = true
+		entry.status = status
+		entry.contentType = contentType
+		entry.body = body
+		entry.expire = time.Now().Add(d.window)
+	} else if d.entries[key] == entry {
+		delete(d.entries, key)
+	}
+	d.mu.Unlock()
+	close(entry.done)
+}
+
+func isDone(entry *dedupEntry) bool {
+	select {
+	case <-entry.done:
+		return true
+	default:
+		return false
+	}
+}
+
+//Idempotency-Key header, or hash of the fields identifying an intercom event
+//user and fid distinguish fan-out pushes which have no device
+func dedupKey(ctx *gin.Context, data []byte) string {
+	if key := ctx.GetHeader(IdempotencyKeyHeader); len(key) > 0 {
+		return "key:" + key
+	}
+	var m push.IntercomMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return ""
+	}
+	return utils.Sha256String(fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n%s\n%f",
+		m.Device, m.User, m.Fid, m.Cid, m.Scheme, m.Cmd, m.CreateTime))
+}
+
+//keeps a copy of the response body
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+//middleware of /push, a duplicate gets the response of the first push
+func (c *Controller) dedupHandlerFunc(ctx *gin.Context) {
+	c.rw.RLock()
+	dedup := c.dedup
+	c.rw.RUnlock()
+	if dedup == nil {
+		return
+	}
+	data, err := ioutil.ReadAll(ctx.Request.Body)
+	if err != nil {
+		return
+	}
+	ctx.Request.Body = ioutil.NopCloser(bytes.NewReader(data))
+	key := dedupKey(ctx, data)
+	if len(key) < 1 {
+		return
+	}
+
+	entry, created := dedup.acquire(key)
+	//a duplicate of a failed push is pushed again
+	for !created {
+		select {
+		case <-entry.done:
+		case <-time.After(dedupWaitTimeout):
+			logrus.Warnf("duplicate push(%s) still in progress", key)
+			ctx.AbortWithStatusJSON(http.StatusConflict, Result{
+				Status:  http.StatusConflict,
+				Message: "duplicate push in progress",
+			})
+			return
+		}
+		if entry.cached {
+			logrus.Infof("duplicate push(%s) replayed", key)
+			ctx.Header(IdempotentReplayedHeader, "true")
+			ctx.Data(entry.status, entry.contentType, entry.body)
+			ctx.Abort()
+			return
+		}
+		entry, created = dedup.acquire(key)
+	}
+
+	recorder := &responseRecorder{ResponseWriter: ctx.Writer}
+	ctx.Writer = recorder
+	defer func() {
+		dedup.record(key, entry, recorder.Status(), recorder.Header().Get("Content-Type"), recorder.body.Bytes())
+	}()
+	ctx.Next()
+}
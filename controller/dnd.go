@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"jingxi.cn/transitservice/registry"
+	"net/http"
+)
+
+//schedules of user or fid query, all if both are empty
+func (c *Controller) listDndHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/dnd called")
+	user := ctx.Query("user")
+	fid := ctx.Query("fid")
+	schedules := c.dnd.Find(func(s *registry.DndSchedule) bool {
+		return (len(user) < 1 || s.UserId == user) && (len(fid) < 1 || s.FamilyId == fid)
+	})
+	if schedules == nil {
+		schedules = []*registry.DndSchedule{}
+	}
+	ctx.JSON(http.StatusOK, schedules)
+}
+
+func (c *Controller) getDndHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/dnd/%s called", ctx.Param("id"))
+	schedule := c.dnd.Get(ctx.Param("id"))
+	if schedule == nil {
+		ctx.JSON(http.StatusNotFound, Result{
+			Status:  http.StatusNotFound,
+			Message: "schedule not found",
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, schedule)
+}
+
+//create schedule, or replace it when id is given
+func (c *Controller) saveDndHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/dnd save called")
+	var schedule registry.DndSchedule
+	if err := ctx.ShouldBindJSON(&schedule); err != nil {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: "Content empty or Content format invalid",
+		})
+		return
+	}
+	if id := ctx.Param("id"); len(id) > 0 {
+		schedule.Id = id
+	}
+	if err := c.dnd.Save(&schedule); err != nil {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, schedule)
+}
+
+func (c *Controller) deleteDndHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/dnd/%s delete called", ctx.Param("id"))
+	if err := c.dnd.Delete(ctx.Param("id")); err != nil {
+		ctx.JSON(http.StatusInternalServerError, Result{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, Result{
+		Status:  http.StatusOK,
+		Message: "success",
+	})
+}
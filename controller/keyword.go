@@ -0,0 +1,252 @@
+package controller
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"jingxi.cn/transitservice/push"
+	"jingxi.cn/transitservice/utils"
+	"net/http"
+	"strconv"
+)
+
+//message replaced by keyword and the rule matched it, nil rule if none matched
+type KeywordTestResponse struct {
+	Rule    *push.KeywordRule    `json:"rule"`
+	Message push.IntercomMessage `json:"message"`
+}
+
+//show the notification a message gets without pushing it
+func (c *Controller) testKeywordHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/keyword/test called")
+	if c.keyword == nil {
+		ctx.JSON(http.StatusServiceUnavailable, Result{
+			Status:  http.StatusServiceUnavailable,
+			Message: "Unsupported handler",
+		})
+		return
+	}
+	var message push.IntercomMessage
+	if err := ctx.ShouldBindJSON(&message); err != nil {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: "Content empty or Content format invalid",
+		})
+		return
+	}
+	rule := c.replaceIntercomMessage(&message)
+	ctx.JSON(http.StatusOK, KeywordTestResponse{
+		Rule:    rule,
+		Message: message,
+	})
+}
+
+type KeywordContentResponse struct {
+	Locale   string          `json:"locale"`
+	Revision *utils.Revision `json:"revision"` //latest revision, nil if never saved by admin api
+	Content  json.RawMessage `json:"content"`
+}
+
+type KeywordDiffResponse struct {
+	From int    `json:"from"`
+	To   int    `json:"to"` //0 is current keyword file
+	Diff string `json:"diff"`
+}
+
+func (c *Controller) checkKeywordStore(ctx *gin.Context) bool {
+	if c.wording == nil {
+		ctx.JSON(http.StatusServiceUnavailable, Result{
+			Status:  http.StatusServiceUnavailable,
+			Message: "Unsupported handler",
+		})
+		return false
+	}
+	return true
+}
+
+//locale of path, default is message.json
+func keywordLocale(ctx *gin.Context) string {
+	if locale := ctx.Param("locale"); locale != "default" {
+		return locale
+	}
+	return ""
+}
+
+//swap keywords of every locale in at once
+func (c *Controller) applyKeywords(keyword *push.Keywords) {
+	c.rw.Lock()
+	c.keyword = keyword
+	c.rw.Unlock()
+}
+
+//check a keyword file without saving it
+func (c *Controller) validateKeywordHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/keyword/validate called")
+	if !c.checkKeywordStore(ctx) {
+		return
+	}
+	data, err := ioutil.ReadAll(ctx.Request.Body)
+	if err == nil {
+		err = c.wording.Validate(data)
+	}
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, Result{
+		Status:  http.StatusOK,
+		Message: "success",
+	})
+}
+
+func (c *Controller) listKeywordHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/keyword called")
+	if !c.checkKeywordStore(ctx) {
+		return
+	}
+	files, err := c.wording.List()
+	if err != nil {
+		revisionError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, files)
+}
+
+func (c *Controller) getKeywordHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/keyword/%s called", ctx.Param("locale"))
+	if !c.checkKeywordStore(ctx) {
+		return
+	}
+	locale := keywordLocale(ctx)
+	content, err := c.wording.Current(locale)
+	if err != nil {
+		revisionError(ctx, err)
+		return
+	}
+	revisions, err := c.wording.Revisions(locale)
+	if err != nil {
+		revisionError(ctx, err)
+		return
+	}
+	response := KeywordContentResponse{
+		Locale:  locale,
+		Content: content,
+	}
+	if len(revisions) > 0 {
+		response.Revision = revisions[len(revisions)-1]
+	}
+	ctx.JSON(http.StatusOK, response)
+}
+
+//save keyword file of locale as a new revision and apply it
+func (c *Controller) saveKeywordHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/keyword/%s save called", ctx.Param("locale"))
+	if !c.checkKeywordStore(ctx) {
+		return
+	}
+	var request RevisionSaveRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil || len(request.Content) < 1 {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: "Content empty or Content format invalid",
+		})
+		return
+	}
+	if err := c.wording.Validate(request.Content); err != nil {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		})
+		return
+	}
+	//reload in progress would swap in keywords loaded before this save
+	c.reloading.Lock()
+	revision, keyword, err := c.wording.Save(keywordLocale(ctx), request.Content, adminUser(ctx), request.Comment)
+	if err == nil {
+		c.applyKeywords(keyword)
+	}
+	c.reloading.Unlock()
+	if err != nil {
+		revisionError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, revision)
+}
+
+func (c *Controller) listKeywordRevisionHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/keyword/%s/revision called", ctx.Param("locale"))
+	if !c.checkKeywordStore(ctx) {
+		return
+	}
+	revisions, err := c.wording.Revisions(keywordLocale(ctx))
+	if err != nil {
+		revisionError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, revisions)
+}
+
+func (c *Controller) getKeywordRevisionHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/keyword/%s/revision/%s called", ctx.Param("locale"), ctx.Param("id"))
+	if !c.checkKeywordStore(ctx) {
+		return
+	}
+	id, _ := strconv.Atoi(ctx.Param("id"))
+	revision, err := c.wording.Revision(keywordLocale(ctx), id)
+	if err != nil {
+		revisionError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, revision)
+}
+
+//diff of revision from to revision to, to is the current keyword file when omitted
+func (c *Controller) diffKeywordHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/keyword/%s/diff called", ctx.Param("locale"))
+	if !c.checkKeywordStore(ctx) {
+		return
+	}
+	from, _ := strconv.Atoi(ctx.Query("from"))
+	to, _ := strconv.Atoi(ctx.Query("to"))
+	diff, err := c.wording.Diff(keywordLocale(ctx), from, to)
+	if err != nil {
+		revisionError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, KeywordDiffResponse{
+		From: from,
+		To:   to,
+		Diff: diff,
+	})
+}
+
+//save a previous revision again as the latest and apply it
+func (c *Controller) rollbackKeywordHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/keyword/%s/rollback called", ctx.Param("locale"))
+	if !c.checkKeywordStore(ctx) {
+		return
+	}
+	var request RevisionRollbackRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: "Content empty or Content format invalid",
+		})
+		return
+	}
+	c.reloading.Lock()
+	revision, keyword, err := c.wording.Rollback(keywordLocale(ctx), request.Revision, adminUser(ctx))
+	if err == nil {
+		c.applyKeywords(keyword)
+	}
+	c.reloading.Unlock()
+	if err != nil {
+		revisionError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, revision)
+}
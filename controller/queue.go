@@ -0,0 +1,41 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"jingxi.cn/transitservice/push"
+	"net/http"
+)
+
+//response of push accepted by queue
+type QueueResponse struct {
+	Status    int      `json:"result"`
+	Message   string   `json:"message"`
+	MessageId string   `json:"messageId"`
+	Jobs      []string `json:"jobs"` //one job per target
+}
+
+//caller waits for provider answer with /push?sync=1
+func isSyncPush(ctx *gin.Context) bool {
+	sync := ctx.Query("sync")
+	return sync == "1" || sync == "true"
+}
+
+func (c *Controller) enqueueMessages(ctx *gin.Context, messages []*push.IntercomMessage) {
+	messageId, jobs, err := c.queue.Enqueue(messages)
+	if err != nil {
+		logrus.Errorf("enqueue push(%s) error: %+v", messageId, err)
+		ctx.JSON(http.StatusServiceUnavailable, Result{
+			Status:  http.StatusServiceUnavailable,
+			Message: err.Error(),
+		})
+		return
+	}
+	logrus.Infof("push(%s) queued to %d targets", messageId, len(jobs))
+	ctx.JSON(http.StatusAccepted, QueueResponse{
+		Status:    http.StatusAccepted,
+		Message:   "queued",
+		MessageId: messageId,
+		Jobs:      jobs,
+	})
+}
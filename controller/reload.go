@@ -0,0 +1,251 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"jingxi.cn/transitservice/conf"
+	"jingxi.cn/transitservice/opensips"
+	"jingxi.cn/transitservice/push"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultReloadDelay = 500 * time.Millisecond
+
+	//in-flight queries of a replaced subscriber service finish before it is closed
+	subscriberCloseDelay = 30 * time.Second
+)
+
+//sections which are applied by restart only, running values are kept on reload
+var restartSections = map[string]bool{
+	"storage":   true,
+	"queue":     true,
+	"broadcast": true,
+	"reload":    true,
+}
+
+//push service and subscriber service are created again when any of their sections changes
+var (
+	pushSections       = []string{"push", "apns", "fcm", "huawei", "xiaomi", "oppo", "vivo", "ttl", "dnd"}
+	subscriberSections = []string{"opensips", "mysql", "kamailio"}
+)
+
+//reads configuration the way it is read on start, e.g. with command line overrides
+type ConfigLoader func() (*conf.ServerConfig, error)
+
+type ReloadResponse struct {
+	Status  int      `json:"result"`
+	Message string   `json:"message"`
+	Changed []string `json:"changed"` //yaml sections, sip.json and message.json
+	Restart []string `json:"restart"` //changed sections which take effect after restart
+}
+
+func (c *Controller) SetConfigLoader(loader ConfigLoader) {
+	c.loader = loader
+}
+
+func (c *Controller) config() *conf.ServerConfig {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+	return c.serverConf
+}
+
+//nil if push is not supported
+func (c *Controller) pushService() *push.PushService {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+	return c.push
+}
+
+func (c *Controller) subService() *opensips.SubService {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+	return c.subscriber
+}
+
+func containsAny(sections []string, names ...string) bool {
+	for _, v := range sections {
+		for _, name := range names {
+			if v == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//read configuration, sip.json and keyword files again, and swap them in at once when all are valid
+//returns changed sections and the ones of them which need restart
+func (c *Controller) Reload() ([]string, []string, error) {
+	c.reloading.Lock()
+	defer c.reloading.Unlock()
+
+	c.rw.RLock()
+	oldConf, oldSipConf, oldKeyword := c.serverConf, c.sipConf, c.keyword
+	pushService, subscriber, provAuth, dedup := c.push, c.subscriber, c.provAuth, c.dedup
+	c.rw.RUnlock()
+
+	serverConf := oldConf
+	if c.loader != nil {
+		loaded, err := c.loader()
+		if err != nil {
+			return nil, nil, err
+		}
+		serverConf = loaded
+	}
+	changed := oldConf.ChangedSections(serverConf)
+	restart := make([]string, 0)
+	for _, v := range changed {
+		if restartSections[v] {
+			restart = append(restart, v)
+		}
+	}
+	serverConf.Storage = oldConf.Storage
+	serverConf.Queue = oldConf.Queue
+	serverConf.Broadcast = oldConf.Broadcast
+	serverConf.Reload = oldConf.Reload
+	//push is enabled or disabled on start only
+	if (pushService != nil) != serverConf.IsSupportPush() {
+		restart = append(restart, "push")
+	}
+
+	template, err := opensips.LoadSipIceTemplate(filepath.Join(c.confDir, "sip.json"))
+	if err == nil {
+		err = template.Validate()
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("sip.json: %v", err)
+	}
+	sipConf, err := buildSipConf(serverConf, template)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(sipConf, oldSipConf) {
+		changed = append(changed, "sip.json")
+	}
+
+	keyword := oldKeyword
+	if oldKeyword != nil {
+		if _, err = c.wording.Sync(); err != nil {
+			logrus.Errorf("sync keyword revisions error: %+v", err)
+		}
+		keyword, err = push.LoadKeywords(c.confDir, serverConf.Locale)
+		if err != nil {
+			return nil, nil, err
+		}
+		if keyword.Digest() != oldKeyword.Digest() {
+			changed = append(changed, "message.json")
+		}
+	}
+
+	if pushService != nil && serverConf.IsSupportPush() && containsAny(changed, pushSections...) {
+		pushService, err = push.NewPushService(serverConf, c.confDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		pushService.SetTokenRegistry(c.tokens)
+		pushService.SetDndRegistry(c.dnd)
+	}
+	oldSubscriber := subscriber
+	if containsAny(changed, subscriberSections...) {
+		subscriber = opensips.NewSubService(serverConf)
+	}
+	if containsAny(changed, "provision") {
+		provAuth = newProvisionAuth(serverConf)
+	}
+	if containsAny(changed, "dedup") {
+		dedup = newDeduplicator(serverConf)
+	}
+
+	c.rw.Lock()
+	c.serverConf = serverConf
+	c.sipConf = sipConf
+	c.proxyConf = newProxyConf(serverConf)
+	c.keyword = keyword
+	c.push = pushService
+	c.subscriber = subscriber
+	c.provAuth = provAuth
+	c.dedup = dedup
+	c.rw.Unlock()
+
+	if c.wording != nil {
+		c.wording.SetLocale(serverConf.Locale)
+	}
+	if c.queue != nil {
+		c.queue.SetService(pushService)
+	}
+	if c.broadcast != nil {
+		c.broadcast.SetService(pushService)
+	}
+	if subscriber != oldSubscriber {
+		time.AfterFunc(subscriberCloseDelay, func() {
+			_ = oldSubscriber.Close()
+		})
+	}
+	logrus.Infof("reloaded, changed: %v, restart required: %v", changed, restart)
+	return changed, restart, nil
+}
+
+//yaml and json files of conf directory
+func isConfigFile(file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	return ext == ".yaml" || ext == ".yml" || ext == ".json"
+}
+
+//reload when configuration, sip.json or keyword files change
+func (c *Controller) watchConfig() error {
+	delay := defaultReloadDelay
+	if c.serverConf.Reload.Delay > 0 {
+		delay = time.Duration(c.serverConf.Reload.Delay) * time.Millisecond
+	}
+	dir := c.confDir
+	if len(dir) < 1 {
+		dir = "."
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err = watcher.Add(dir); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+	c.watcher = watcher
+
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op == fsnotify.Chmod || !isConfigFile(event.Name) {
+					continue
+				}
+				//editors write a file in several steps, reload once changes settle
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(delay, c.reloadByWatch)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logrus.Errorf("watch %s error: %+v", dir, err)
+			}
+		}
+	}()
+	logrus.Infof("watch %s for configuration changes", dir)
+	return nil
+}
+
+func (c *Controller) reloadByWatch() {
+	if _, _, err := c.Reload(); err != nil {
+		logrus.Errorf("reload on file change failed, running configuration kept: %+v", err)
+	}
+}
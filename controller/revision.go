@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"jingxi.cn/transitservice/push"
+	"jingxi.cn/transitservice/utils"
+	"net/http"
+	"os"
+)
+
+//content saved by admin api as a new revision, author is the admin user
+type RevisionSaveRequest struct {
+	Comment string          `json:"comment"`
+	Content json.RawMessage `json:"content"`
+}
+
+type RevisionRollbackRequest struct {
+	Revision int `json:"revision"`
+}
+
+func revisionError(ctx *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, push.ErrInvalidLocale):
+		status = http.StatusBadRequest
+	case errors.Is(err, utils.ErrRevisionNotFound), os.IsNotExist(err):
+		status = http.StatusNotFound
+	}
+	ctx.JSON(status, Result{
+		Status:  status,
+		Message: err.Error(),
+	})
+}
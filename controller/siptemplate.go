@@ -0,0 +1,191 @@
+package controller
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"jingxi.cn/transitservice/opensips"
+	"jingxi.cn/transitservice/registry"
+	"jingxi.cn/transitservice/utils"
+	"net/http"
+	"strconv"
+)
+
+const maskedPassword = "******"
+
+type SipTemplateResponse struct {
+	Revision *utils.Revision `json:"revision"` //latest revision, nil if never saved by admin api
+	Content  json.RawMessage `json:"content"`
+}
+
+func (c *Controller) getSipTemplateHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/opensip/v2/template called")
+	content, err := c.sipStore.Current()
+	if err != nil {
+		revisionError(ctx, err)
+		return
+	}
+	revisions, err := c.sipStore.Revisions()
+	if err != nil {
+		revisionError(ctx, err)
+		return
+	}
+	response := SipTemplateResponse{Content: content}
+	if len(revisions) > 0 {
+		response.Revision = revisions[len(revisions)-1]
+	}
+	ctx.JSON(http.StatusOK, response)
+}
+
+//check a sip.json template without saving it
+func (c *Controller) validateSipTemplateHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/opensip/v2/template/validate called")
+	data, err := ioutil.ReadAll(ctx.Request.Body)
+	if err == nil {
+		_, err = opensips.ParseSipIceTemplate(data)
+	}
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, Result{
+		Status:  http.StatusOK,
+		Message: "success",
+	})
+}
+
+//save sip.json as a new revision, registers get it without restart
+func (c *Controller) saveSipTemplateHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/opensip/v2/template save called")
+	var request RevisionSaveRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil || len(request.Content) < 1 {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: "Content empty or Content format invalid",
+		})
+		return
+	}
+	if _, err := opensips.ParseSipIceTemplate(request.Content); err != nil {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		})
+		return
+	}
+	//reload in progress would swap in sip.json loaded before this save
+	c.reloading.Lock()
+	revision, template, err := c.sipStore.Save(request.Content, adminUser(ctx), request.Comment)
+	if err == nil {
+		err = c.applySipTemplate(template)
+	}
+	c.reloading.Unlock()
+	if err != nil {
+		revisionError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, revision)
+}
+
+func (c *Controller) listSipTemplateRevisionHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/opensip/v2/template/revision called")
+	revisions, err := c.sipStore.Revisions()
+	if err != nil {
+		revisionError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, revisions)
+}
+
+func (c *Controller) getSipTemplateRevisionHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/opensip/v2/template/revision/%s called", ctx.Param("id"))
+	id, _ := strconv.Atoi(ctx.Param("id"))
+	revision, err := c.sipStore.Revision(id)
+	if err != nil {
+		revisionError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, revision)
+}
+
+//save a previous revision again as the latest and apply it
+func (c *Controller) rollbackSipTemplateHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/opensip/v2/template/rollback called")
+	var request RevisionRollbackRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: "Content empty or Content format invalid",
+		})
+		return
+	}
+	c.reloading.Lock()
+	revision, template, err := c.sipStore.Rollback(request.Revision, adminUser(ctx))
+	if err == nil {
+		err = c.applySipTemplate(template)
+	}
+	c.reloading.Unlock()
+	if err != nil {
+		revisionError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, revision)
+}
+
+//response a registered device gets from /opensip/v2/register, password is masked
+//device is looked up by ?username= or ?cid=, template is the current one, ?revision= or the posted one
+func (c *Controller) previewSipTemplateHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/opensip/v2/template/preview called")
+	var device *registry.Device
+	if username := ctx.Query("username"); len(username) > 0 {
+		device = c.devices.Get(username)
+	} else if cid := ctx.Query("cid"); len(cid) > 0 {
+		device = c.devices.FindByClientId(cid)
+	}
+	if device == nil {
+		ctx.JSON(http.StatusNotFound, Result{
+			Status:  http.StatusNotFound,
+			Message: "device not found",
+		})
+		return
+	}
+
+	var template *opensips.SipIceConfig
+	var err error
+	if ctx.Request.Method == http.MethodPost {
+		var data []byte
+		if data, err = ioutil.ReadAll(ctx.Request.Body); err == nil {
+			template, err = opensips.ParseSipIceTemplate(data)
+		}
+	} else if id, _ := strconv.Atoi(ctx.Query("revision")); id > 0 {
+		var revision *utils.Revision
+		if revision, err = c.sipStore.Revision(id); err != nil {
+			revisionError(ctx, err)
+			return
+		}
+		template, err = opensips.ParseSipIceTemplate(revision.Content)
+	}
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	user := opensips.NewUser(c.config().Opensips.Domain, device.Username, maskedPassword)
+	if template == nil {
+		if template, err = c.createSipIceConfig(user); err != nil {
+			revisionError(ctx, err)
+			return
+		}
+	} else {
+		template.ReplaceSipServer(c.config().Opensips.SipServer)
+		template.ReplaceStunServer(c.config().Opensips.StunServer)
+		template.ReplaceUser(c.identityHost(), user.Username, user.Password)
+	}
+	c.writeSipIceConfig(ctx, template)
+}
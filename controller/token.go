@@ -0,0 +1,193 @@
+package controller
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"jingxi.cn/transitservice/push"
+	"jingxi.cn/transitservice/registry"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//response of push to several targets
+type PushResponse struct {
+	Status  int                    `json:"result"`
+	Message string                 `json:"message"`
+	Results []*push.DeliveryResult `json:"results"`
+}
+
+//push each message, success if any one delivered or held back by do-not-disturb
+func (c *Controller) pushMessages(ctx *gin.Context, messages []*push.IntercomMessage) {
+	response := PushResponse{
+		Status:  http.StatusServiceUnavailable,
+		Message: "all push failed",
+		Results: c.pushService().PushAll(messages),
+	}
+	for k, result := range response.Results {
+		c.checkDeadLetter(messages[k], result, nil)
+		if result.Success || result.Suppressed || result.Dropped {
+			response.Status = http.StatusOK
+			response.Message = "success"
+		}
+	}
+	logrus.Infof("push to %d targets: %s", len(messages), response.Message)
+	ctx.JSON(response.Status, response)
+}
+
+//credential of a resident signed for user and family: <expire>.<hex hmac-sha256(secret, user\nfid\nexpire)>
+func checkTokenCredential(secret string, credential string, user string, fid string) bool {
+	pos := strings.IndexByte(credential, '.')
+	if len(secret) < 1 || pos < 1 {
+		return false
+	}
+	expire, err := strconv.ParseInt(credential[:pos], 10, 64)
+	if err != nil || time.Now().Unix() > expire {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(user + "\n" + fid + "\n" + credential[:pos]))
+	return hmac.Equal([]byte(credential[pos+1:]), []byte(hex.EncodeToString(mac.Sum(nil))))
+}
+
+//request carries the credential of user and family, false if unauthorized was answered
+func (c *Controller) authorizeToken(ctx *gin.Context, user string, fid string) bool {
+	auth := ctx.GetHeader("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") &&
+		checkTokenCredential(c.config().TokenAuth.Secret, strings.TrimSpace(auth[7:]), user, fid) {
+		return true
+	}
+	logrus.Errorf("%s of user(%s) fid(%s) unauthorized from %s", ctx.Request.URL.Path, user, fid, ctx.Request.RemoteAddr)
+	ctx.Header("WWW-Authenticate", `Bearer realm="push token"`)
+	ctx.JSON(http.StatusUnauthorized, Result{
+		Status:  http.StatusUnauthorized,
+		Message: "Unauthorized",
+	})
+	return false
+}
+
+//app install binds its push identity to the resident of the credential
+func (c *Controller) registerTokenHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/token/register called")
+	var token registry.PushToken
+	if err := ctx.ShouldBindJSON(&token); err != nil {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: "Content empty or Content format invalid",
+		})
+		return
+	}
+	if !c.authorizeToken(ctx, token.UserId, token.FamilyId) {
+		return
+	}
+	if pushService := c.pushService(); pushService != nil {
+		if _, err := pushService.Provider(token.Provider); err != nil {
+			ctx.JSON(http.StatusBadRequest, Result{
+				Status:  http.StatusBadRequest,
+				Message: err.Error(),
+			})
+			return
+		}
+	}
+	if err := c.tokens.Register(&token); err != nil {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, Result{
+		Status:  http.StatusOK,
+		Message: "success",
+	})
+}
+
+func (c *Controller) refreshTokenHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/token/refresh called")
+	var req struct {
+		Id    string `json:"id"`
+		Token string `json:"token"`
+	}
+	if err := ctx.ShouldBindJSON(&req); err != nil || len(req.Id) < 1 {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: "Content empty or Content format invalid",
+		})
+		return
+	}
+	token := c.tokens.Get(req.Id)
+	if token == nil {
+		ctx.JSON(http.StatusNotFound, Result{
+			Status:  http.StatusNotFound,
+			Message: "push token not found",
+		})
+		return
+	}
+	if !c.authorizeToken(ctx, token.UserId, token.FamilyId) {
+		return
+	}
+	if err := c.tokens.Refresh(req.Id, req.Token); err != nil {
+		ctx.JSON(http.StatusNotFound, Result{
+			Status:  http.StatusNotFound,
+			Message: err.Error(),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, Result{
+		Status:  http.StatusOK,
+		Message: "success",
+	})
+}
+
+func (c *Controller) unregisterTokenHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/token/unregister called")
+	var req struct {
+		Id string `json:"id"`
+	}
+	if err := ctx.ShouldBindJSON(&req); err != nil || len(req.Id) < 1 {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: "Content empty or Content format invalid",
+		})
+		return
+	}
+	if token := c.tokens.Get(req.Id); token != nil && !c.authorizeToken(ctx, token.UserId, token.FamilyId) {
+		return
+	}
+	if err := c.tokens.Unregister(req.Id); err != nil {
+		ctx.JSON(http.StatusInternalServerError, Result{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, Result{
+		Status:  http.StatusOK,
+		Message: "success",
+	})
+}
+
+//?user=&fid=, one of them is required
+func (c *Controller) listTokenHandlerFunc(ctx *gin.Context) {
+	logrus.Infof("/push/token called")
+	user := ctx.Query("user")
+	fid := ctx.Query("fid")
+	if len(user) < 1 && len(fid) < 1 {
+		ctx.JSON(http.StatusBadRequest, Result{
+			Status:  http.StatusBadRequest,
+			Message: "user or fid required",
+		})
+		return
+	}
+	tokens := c.tokens.Find(func(t *registry.PushToken) bool {
+		return (len(user) < 1 || t.UserId == user) && (len(fid) < 1 || t.FamilyId == fid)
+	})
+	if tokens == nil {
+		tokens = []*registry.PushToken{}
+	}
+	ctx.JSON(http.StatusOK, tokens)
+}
@@ -23,6 +23,7 @@ type CmdLine struct {
 	pprof    string
 	confDir  string
 	logDir   string
+	check    bool
 
 	sipServer  string
 	stunServer string
@@ -41,6 +42,7 @@ func init() {
 	flag.StringVar(&cmdline.pprof, "pprof", "", "0.0.0.0:6060")
 	flag.StringVar(&cmdline.confDir, "conf", "", "/app/conf")
 	flag.StringVar(&cmdline.logDir, "log", "", "/app/log")
+	flag.BoolVar(&cmdline.check, "check-config", false, "check configuration and exit, 0 ok, 1 invalid, 2 unreachable")
 
 	flag.StringVar(&cmdline.sipServer, "sip", "", "1.1.1.1:18888")
 	flag.StringVar(&cmdline.stunServer, "stun", "", "1.1.1.1:18888")
@@ -54,7 +56,7 @@ func init() {
 func runProfServer() {
 	err := http.ListenAndServe(cmdline.pprof, nil)
 	if err != nil {
-		logrus.Error("start pprof server %s failed: %+v\n", cmdline.pprof, err)
+		logrus.Errorf("start pprof server %s failed: %+v\n", cmdline.pprof, err)
 	}
 }
 
@@ -108,6 +110,20 @@ func setArgsFromCommandLine(conf *conf.ServerConfig) {
 func main() {
 	flag.Parse()
 
+	yaml := filepath.Join(cmdline.confDir, "transit_service_conf.yaml")
+	loadServerConfig := func() (*conf.ServerConfig, error) {
+		serverConf, err := conf.LoadServerConfig(yaml)
+		if err != nil {
+			return nil, err
+		}
+		setArgsFromCommandLine(serverConf)
+		return serverConf, nil
+	}
+	if cmdline.check {
+		logrus.SetLevel(logrus.WarnLevel)
+		os.Exit(cmd.CheckConfig(yaml, loadServerConfig, cmdline.confDir, os.Stdout))
+	}
+
 	initLog()
 
 	if len(cmdline.httpAddr) < 1 {
@@ -119,13 +135,13 @@ func main() {
 		go runProfServer()
 	}
 
-	yaml := filepath.Join(cmdline.confDir, "transit_service_conf.yaml")
-	serverConf, err := conf.LoadServerConfig(yaml)
+	serverConf, err := loadServerConfig()
 	if err != nil {
 		logrus.Fatalf("read file(%s) failed: %+v", yaml, err)
 		return
 	}
-	setArgsFromCommandLine(serverConf)
+
+	cmd.SelfCheck(yaml, serverConf, cmdline.confDir)
 
 	_ = serverConf.WriteConfigToFile(filepath.Join(cmdline.logDir, "current.json"))
 	_ = utils.SaveAppStartTime(cmdline.logDir)
@@ -134,5 +150,6 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 	app := cmd.NewApp()
+	app.SetConfigLoader(loadServerConfig)
 	app.Run(serverConf, cmdline.confDir, cmdline.httpAddr)
 }
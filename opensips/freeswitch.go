@@ -0,0 +1,116 @@
+package opensips
+
+import (
+	"encoding/xml"
+)
+
+/*
+FreeSWITCH mod_xml_curl directory binding
+https://developer.signalwire.com/freeswitch/FreeSWITCH-Explained/Modules/mod_xml_curl_1049001/
+
+request form: section=directory&action=sip_auth&user=1000&domain=1.1.1.1&...
+
+<document type="freeswitch/xml">
+  <section name="directory">
+    <domain name="1.1.1.1">
+      <user id="1000">
+        <params><param name="a1-hash" value="..."/></params>
+        <variables><variable name="user_context" value="default"/></variables>
+      </user>
+    </domain>
+  </section>
+</document>
+*/
+
+const FreeswitchDocumentType = "freeswitch/xml"
+
+type FreeswitchParam struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type FreeswitchUser struct {
+	Id        string            `xml:"id,attr"`
+	Params    []FreeswitchParam `xml:"params>param"`
+	Variables []FreeswitchParam `xml:"variables>variable"`
+}
+
+type FreeswitchGroup struct {
+	Name  string           `xml:"name,attr"`
+	Users []FreeswitchUser `xml:"users>user"`
+}
+
+type FreeswitchDomain struct {
+	Name   string            `xml:"name,attr"`
+	Params []FreeswitchParam `xml:"params>param"`
+	Groups []FreeswitchGroup `xml:"groups>group"`
+}
+
+type FreeswitchResult struct {
+	Status string `xml:"status,attr"`
+}
+
+type FreeswitchSection struct {
+	Name   string            `xml:"name,attr"`
+	Domain *FreeswitchDomain `xml:"domain,omitempty"`
+	Result *FreeswitchResult `xml:"result,omitempty"`
+}
+
+type FreeswitchDocument struct {
+	XMLName xml.Name          `xml:"document"`
+	Type    string            `xml:"type,attr"`
+	Section FreeswitchSection `xml:"section"`
+}
+
+//directory lookup answer, a1-hash is md5(user:domain:password) of the requested domain
+func NewFreeswitchDirectory(domain string, user *User, plainPassword bool, variables []FreeswitchParam) *FreeswitchDocument {
+	var params []FreeswitchParam
+	if plainPassword {
+		params = append(params, FreeswitchParam{Name: "password", Value: user.Password})
+	} else {
+		hashUser := *user
+		hashUser.Domain = domain
+		hashUser.Realm = ""
+		params = append(params, FreeswitchParam{Name: "a1-hash", Value: GetHa1(&hashUser)})
+	}
+	return &FreeswitchDocument{
+		Type: FreeswitchDocumentType,
+		Section: FreeswitchSection{
+			Name: "directory",
+			Domain: &FreeswitchDomain{
+				Name: domain,
+				Params: []FreeswitchParam{{
+					Name:  "dial-string",
+					Value: "{^^:sip_invite_domain=${dialed_domain}:presence_id=${dialed_user}@${dialed_domain}}${sofia_contact(*/${dialed_user}@${dialed_domain})}",
+				}},
+				Groups: []FreeswitchGroup{{
+					Name: "default",
+					Users: []FreeswitchUser{{
+						Id:        user.Username,
+						Params:    params,
+						Variables: variables,
+					}},
+				}},
+			},
+		},
+	}
+}
+
+//FreeSWITCH falls back to other bindings or static xml
+func NewFreeswitchNotFound() *FreeswitchDocument {
+	return &FreeswitchDocument{
+		Type: FreeswitchDocumentType,
+		Section: FreeswitchSection{
+			Name:   "result",
+			Result: &FreeswitchResult{Status: "not found"},
+		},
+	}
+}
+
+func (d *FreeswitchDocument) Marshal() ([]byte, error) {
+	data, err := xml.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
@@ -0,0 +1,90 @@
+package opensips
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+//https://www.kamailio.org/docs/modules/stable/modules/jsonrpcs.html
+type RpcRequest struct {
+	Jsonrpc string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params,omitempty"`
+	Id      int64         `json:"id"`
+}
+
+type RpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type RpcResponse struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result"`
+	Error   *RpcError       `json:"error"`
+	Id      int64           `json:"id"`
+}
+
+func (e *RpcError) Error() string {
+	return fmt.Sprintf("jsonrpc error %d: %s", e.Code, e.Message)
+}
+
+//jsonrpcs client over xhttp
+type KamailioRpc struct {
+	url    string
+	client *http.Client
+	seq    int64
+}
+
+func NewKamailioRpc(url string) *KamailioRpc {
+	return &KamailioRpc{
+		url: url,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+func (k *KamailioRpc) Call(method string, params ...interface{}) (json.RawMessage, error) {
+	data, err := json.Marshal(RpcRequest{
+		Jsonrpc: "2.0",
+		Method:  method,
+		Params:  params,
+		Id:      atomic.AddInt64(&k.seq, 1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := k.client.Post(k.url, "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var r RpcResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jsonrpc response(%d): %s", resp.StatusCode, string(body))
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+	return r.Result, nil
+}
+
+//ul.rm removes all contacts of aor, aor not found is not an error
+func (k *KamailioRpc) FlushLocation(table string, aor string) error {
+	_, err := k.Call("ul.rm", table, aor)
+	if e, ok := err.(*RpcError); ok && e.Code == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
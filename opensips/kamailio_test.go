@@ -0,0 +1,98 @@
+package opensips
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+//fake jsonrpcs answering every call with reply, requests are kept in order
+func newFakeKamailio(t *testing.T, reply string) (*httptest.Server, *[]RpcRequest) {
+	requests := make([]RpcRequest, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method %s, want POST", r.Method)
+		}
+		var request RpcRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		requests = append(requests, request)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, reply, request.Id)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestFlushLocationRequest(t *testing.T) {
+	server, requests := newFakeKamailio(t, `{"jsonrpc":"2.0","result":"ok","id":%d}`)
+	rpc := NewKamailioRpc(server.URL)
+	if err := rpc.FlushLocation("location", "1000@example.com"); err != nil {
+		t.Fatalf("FlushLocation: %v", err)
+	}
+	if len(*requests) != 1 {
+		t.Fatalf("%d requests, want 1", len(*requests))
+	}
+	request := (*requests)[0]
+	if request.Jsonrpc != "2.0" || request.Method != "ul.rm" {
+		t.Errorf("request %+v, want jsonrpc 2.0 ul.rm", request)
+	}
+	want := []interface{}{"location", "1000@example.com"}
+	if !reflect.DeepEqual(request.Params, want) {
+		t.Errorf("params %v, want %v", request.Params, want)
+	}
+	if request.Id < 1 {
+		t.Errorf("id %d, want positive", request.Id)
+	}
+}
+
+func TestFlushLocationNotFound(t *testing.T) {
+	server, _ := newFakeKamailio(t, `{"jsonrpc":"2.0","error":{"code":404,"message":"AOR not found"},"id":%d}`)
+	if err := NewKamailioRpc(server.URL).FlushLocation("location", "1000@example.com"); err != nil {
+		t.Fatalf("FlushLocation of unknown aor: %v, want nil", err)
+	}
+}
+
+func TestFlushLocationError(t *testing.T) {
+	server, _ := newFakeKamailio(t, `{"jsonrpc":"2.0","error":{"code":500,"message":"table not found"},"id":%d}`)
+	err := NewKamailioRpc(server.URL).FlushLocation("nolocation", "1000@example.com")
+	e, ok := err.(*RpcError)
+	if !ok {
+		t.Fatalf("error %v, want *RpcError", err)
+	}
+	if e.Code != 500 || e.Message != "table not found" {
+		t.Errorf("error %+v, want 500 table not found", e)
+	}
+}
+
+func TestCallResult(t *testing.T) {
+	server, requests := newFakeKamailio(t, `{"jsonrpc":"2.0","result":{"uptime":42},"id":%d}`)
+	rpc := NewKamailioRpc(server.URL)
+	result, err := rpc.Call("core.uptime")
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if string(result) != `{"uptime":42}` {
+		t.Errorf("result %s", result)
+	}
+	if _, err = rpc.Call("core.uptime"); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if (*requests)[0].Params != nil || (*requests)[1].Id <= (*requests)[0].Id {
+		t.Errorf("requests %+v, want no params and increasing ids", *requests)
+	}
+}
+
+func TestCallInvalidResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+	if _, err := NewKamailioRpc(server.URL).Call("ul.rm", "location", "1000"); err == nil {
+		t.Fatal("Call of non jsonrpc endpoint succeeded, want error")
+	}
+}
@@ -0,0 +1,126 @@
+package opensips
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+)
+
+/*
+Linphone remote provisioning document
+https://wiki.linphone.org/xwiki/wiki/public/view/Lib/Features/Remote%20Provisioning/
+
+<?xml version="1.0" encoding="UTF-8"?>
+<config xmlns="http://www.linphone.org/xsds/lpconfig.xsd">
+  <section name="proxy_0">
+    <entry name="reg_proxy" overwrite="true">&lt;sip:1.1.1.1:5060;transport=udp&gt;</entry>
+  </section>
+</config>
+*/
+
+const linphoneNamespace = "http://www.linphone.org/xsds/lpconfig.xsd"
+
+type LinphoneEntry struct {
+	Name      string `xml:"name,attr"`
+	Overwrite bool   `xml:"overwrite,attr,omitempty"`
+	Value     string `xml:",chardata"`
+}
+
+type LinphoneSection struct {
+	Name    string          `xml:"name,attr"`
+	Entries []LinphoneEntry `xml:"entry"`
+}
+
+type LinphoneConfig struct {
+	XMLName  xml.Name          `xml:"config"`
+	Xmlns    string            `xml:"xmlns,attr"`
+	Sections []LinphoneSection `xml:"section"`
+}
+
+func (l *LinphoneConfig) addSection(name string, pairs ...string) {
+	section := LinphoneSection{Name: name}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if len(pairs[i+1]) < 1 {
+			continue
+		}
+		section.Entries = append(section.Entries, LinphoneEntry{
+			Name:      pairs[i],
+			Overwrite: true,
+			Value:     pairs[i+1],
+		})
+	}
+	l.Sections = append(l.Sections, section)
+}
+
+//<sip:server> -> <sip:server;transport=tcp>
+func proxyWithTransport(proxy string, transport string) string {
+	if len(transport) < 1 || strings.Contains(proxy, "transport=") {
+		return proxy
+	}
+	if strings.HasSuffix(proxy, ">") {
+		return proxy[:len(proxy)-1] + ";transport=" + strings.ToLower(transport) + ">"
+	}
+	return proxy + ";transport=" + strings.ToLower(transport)
+}
+
+func boolString(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+//convert credentials, proxy and STUN/TURN settings to a Linphone config document
+func (s *SipIceConfig) LinphoneConfig(realm string) *LinphoneConfig {
+	l := &LinphoneConfig{Xmlns: linphoneNamespace}
+
+	l.addSection("sip",
+		"default_proxy", "0",
+		"use_rport", boolString(s.Sip.UseRport),
+		"user_agent", s.Sip.UserAgent)
+
+	for k, v := range s.Sip.Proxy {
+		l.addSection("proxy_"+strconv.Itoa(k),
+			"reg_proxy", proxyWithTransport(v.Proxy, s.Sip.Transport),
+			"reg_identity", v.Identity,
+			"reg_expires", strconv.Itoa(v.Expires),
+			"reg_sendregister", "1",
+			"realm", realm,
+			"nat_policy_ref", "nat_policy_0")
+	}
+	for k, v := range s.Sip.Auth {
+		l.addSection("auth_info_"+strconv.Itoa(k),
+			"username", v.Username,
+			"userid", v.Userid,
+			"passwd", v.Passwd,
+			"realm", realm)
+	}
+
+	stunServer := s.Ice.StunServer
+	protocols := "stun,ice"
+	if len(s.Ice.TurnServer) > 0 {
+		stunServer = s.Ice.TurnServer
+		protocols = "stun,turn,ice"
+	}
+	l.addSection("nat_policy_0",
+		"ref", "nat_policy_0",
+		"stun_server", stunServer,
+		"stun_server_username", s.Ice.TurnUsername,
+		"protocols", protocols)
+	if len(s.Ice.TurnServer) > 0 && len(s.Ice.TurnUsername) > 0 {
+		//linphone finds turn password in auth_info by stun_server_username
+		l.addSection("auth_info_"+strconv.Itoa(len(s.Sip.Auth)),
+			"username", s.Ice.TurnUsername,
+			"passwd", s.Ice.TurnPwd,
+			"realm", s.Ice.TurnAuthrealm)
+	}
+	return l
+}
+
+func (l *LinphoneConfig) Marshal() ([]byte, error) {
+	data, err := xml.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
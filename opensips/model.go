@@ -52,6 +52,11 @@ type UserRequest struct {
 		Version      int    `json:"v"`
 		SerialNumber string `json:"n"`
 		Number       string `json:"m"`
+		//community, building and unit of the room, sent only by firmware which reports room location
+		//empty for older firmware, such devices are not matched by community broadcasts
+		Community string `json:"cm"`
+		Building  string `json:"bd"`
+		Unit      string `json:"u"`
 	} `json:"client"`
 }
 
@@ -0,0 +1,62 @@
+package opensips
+
+import (
+	"jingxi.cn/transitservice/conf"
+	"strings"
+)
+
+/*
+Kamailio 5.x subscriber table, auth_db uses ha1/ha1b and has no email_address, rpid
+
+CREATE TABLE `subscriber` (
+    `id` INT(10) UNSIGNED AUTO_INCREMENT PRIMARY KEY NOT NULL,
+    `username` VARCHAR(64) DEFAULT '' NOT NULL,
+    `domain` VARCHAR(64) DEFAULT '' NOT NULL,
+    `password` VARCHAR(64) DEFAULT '' NOT NULL,
+    `ha1` VARCHAR(128) DEFAULT '' NOT NULL,
+    `ha1b` VARCHAR(128) DEFAULT '' NOT NULL,
+    CONSTRAINT account_idx UNIQUE (`username`, `domain`)
+);
+*/
+
+//subscriber table column names and hashing convention of the sip proxy
+type Schema struct {
+	columns map[string]string //logical column -> table column
+	legacy  map[string]bool   //optional columns used when detection failed
+	realm   string            //auth realm of hashes, empty is user domain
+}
+
+func NewSchema(serverConf *conf.ServerConfig) *Schema {
+	s := &Schema{
+		columns: make(map[string]string),
+		legacy:  legacyColumns,
+		realm:   "",
+	}
+	if serverConf.IsKamailio() {
+		k := serverConf.Kamailio
+		s.legacy = map[string]bool{"ha1b": true}
+		s.realm = k.Realm
+		s.setColumn("password", k.PasswordColumn)
+		s.setColumn("ha1", k.Ha1Column)
+		s.setColumn("ha1b", k.Ha1bColumn)
+	}
+	return s
+}
+
+func (s *Schema) setColumn(name string, column string) {
+	if len(column) > 0 {
+		s.columns[name] = strings.ToLower(column)
+	}
+}
+
+//table column name of logical column
+func (s *Schema) Column(name string) string {
+	if v, ok := s.columns[name]; ok {
+		return v
+	}
+	return name
+}
+
+func (s *Schema) Realm() string {
+	return s.realm
+}
@@ -14,13 +14,29 @@ import (
 type SubService struct {
 	DB         *sql.DB
 	serverConf *conf.ServerConfig
+	columns    map[string]bool //columns of subscriber table, detected when connected
+	schema     *Schema         //column names and hashing of the sip proxy
+	rpc        *KamailioRpc    //flush kamailio location when credential changed, nil is disabled
 }
 
+//columns which old or new OpenSIPS schemas may not have
+var optionalColumns = []string{"email_address", "ha1b", "rpid", "ha1_sha256", "ha1_sha512t256"}
+
+//OpenSIPS 2.x schema, used when column detection failed
+var legacyColumns = map[string]bool{"email_address": true, "ha1b": true, "rpid": true}
+
 func NewSubService(conf *conf.ServerConfig) *SubService {
-	return &SubService{
+	s := &SubService{
 		DB:         nil,
 		serverConf: conf,
+		columns:    nil,
+		schema:     NewSchema(conf),
+		rpc:        nil,
+	}
+	if conf.IsKamailio() && len(conf.Kamailio.RpcUrl) > 0 {
+		s.rpc = NewKamailioRpc(conf.Kamailio.RpcUrl)
 	}
+	return s
 }
 
 func InitDatabase(conf *conf.ServerConfig) (*sql.DB, error) {
@@ -58,19 +74,121 @@ func (s *SubService) EnsureDatabase() error {
 			return err
 		}
 		s.DB = db //connect success!
+		s.detectColumns()
 	}
 	return nil
 }
 
+//find out which optional columns the configured table has
+func (s *SubService) detectColumns() {
+	s.columns = nil
+	ctx, cancelfunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelfunc()
+	rows, err := s.DB.QueryContext(ctx, fmt.Sprintf("select * from %s limit 0", s.serverConf.Mysql.Table))
+	if err != nil {
+		logrus.Errorf("Detect columns of table(%s) error %+v, use legacy schema", s.serverConf.Mysql.Table, err)
+		return
+	}
+	defer rows.Close()
+	names, err := rows.Columns()
+	if err != nil {
+		logrus.Errorf("Detect columns of table(%s) error %+v, use legacy schema", s.serverConf.Mysql.Table, err)
+		return
+	}
+	columns := make(map[string]bool)
+	for _, name := range names {
+		columns[strings.ToLower(name)] = true
+	}
+	s.columns = columns
+	logrus.Infof("table(%s) columns: %v", s.serverConf.Mysql.Table, names)
+}
+
+func (s *SubService) hasColumn(name string) bool {
+	if s.columns == nil {
+		return s.schema.legacy[name]
+	}
+	return s.columns[s.schema.Column(name)]
+}
+
+//auth realm of user hashes
+func (s *SubService) Realm() string {
+	return s.schema.Realm()
+}
+
+//digest hash columns of the subscriber table, valid after database connected
+func (s *SubService) HashColumns() HashColumns {
+	return HashColumns{
+		Ha1b:          s.hasColumn("ha1b"),
+		Ha1Sha256:     s.hasColumn("ha1_sha256"),
+		Ha1Sha512t256: s.hasColumn("ha1_sha512t256"),
+	}
+}
+
+//column names and pointers to the User fields of columns the table has
+func (s *SubService) userFields(user *User, withRpid bool) ([]string, []interface{}) {
+	names := []string{"username", "domain", "password", "ha1"}
+	fields := []interface{}{&user.Username, &user.Domain, &user.Password, &user.Ha1}
+	optional := map[string]interface{}{
+		"email_address":  &user.EmailAddress,
+		"ha1b":           &user.Ha1b,
+		"rpid":           &user.Rpid,
+		"ha1_sha256":     &user.Ha1Sha256,
+		"ha1_sha512t256": &user.Ha1Sha512t256,
+	}
+	for _, name := range optionalColumns {
+		if !s.hasColumn(name) || (name == "rpid" && !withRpid) {
+			continue
+		}
+		names = append(names, name)
+		fields = append(fields, optional[name])
+	}
+	for k, v := range names {
+		names[k] = s.schema.Column(v)
+	}
+	return names, fields
+}
+
+//kamailio caches contacts in usrloc, so registered contacts with old credential are removed
+func (s *SubService) flushLocation(user *User) {
+	if s.rpc == nil {
+		return
+	}
+	table := s.serverConf.Kamailio.LocationTable
+	if len(table) < 1 {
+		table = "location"
+	}
+	aor := user.Username
+	if s.serverConf.Kamailio.UseDomain {
+		aor = user.Username + "@" + user.Domain
+	}
+	if err := s.rpc.FlushLocation(table, aor); err != nil {
+		logrus.Errorf("Flush kamailio location(%s) error %+v", aor, err)
+		return
+	}
+	logrus.Infof("Flush kamailio location(%s) success", aor)
+}
+
+//dereference field pointers for Exec
+func fieldValues(fields []interface{}) []interface{} {
+	values := make([]interface{}, 0, len(fields))
+	for _, f := range fields {
+		values = append(values, *(f.(*string)))
+	}
+	return values
+}
+
 func (s *SubService) AddUser(user *User) error {
 	err := s.EnsureDatabase()
 	if err != nil {
 		return err
 	}
 
+	names, fields := s.userFields(user, true)
 	var query strings.Builder
-	_, err = fmt.Fprintf(&query, "insert into %s(username,domain,password,email_address,ha1,ha1b,rpid) VALUES (?,?,?,?,?,?,?)",
-		s.serverConf.Mysql.Table)
+	_, err = fmt.Fprintf(&query, "insert into %s(%s) VALUES (%s)",
+		s.serverConf.Mysql.Table,
+		strings.Join(names, ","),
+		strings.TrimSuffix(strings.Repeat("?,", len(names)), ","))
 	if err != nil {
 		logrus.Errorf("Build SQL string(%s) error %+v when Add User(%s)", query.String(), err, user.Username)
 		return err
@@ -84,7 +202,7 @@ func (s *SubService) AddUser(user *User) error {
 		return err
 	}
 	defer stmt.Close()
-	res, err := stmt.ExecContext(ctx, user.Username, user.Domain, user.Password, user.EmailAddress, user.Ha1, user.Ha1b, user.Rpid)
+	res, err := stmt.ExecContext(ctx, fieldValues(fields)...)
 	if err != nil {
 		logrus.Errorf("Exec SQL statement(%s) error %+v when Add User(%+v)", query.String(), err, user)
 		return err
@@ -111,9 +229,12 @@ func (s *SubService) UpdateUser(user *User) error {
 	if err != nil {
 		return err
 	}
+	names, fields := s.userFields(user, false)
 	var query strings.Builder
-	_, err = fmt.Fprintf(&query, "UPDATE %s set username=?, domain=?, password=?, email_address=?, ha1=?, ha1b=? where username='%s'",
+	_, err = fmt.Fprintf(&query, "UPDATE %s set %s=? where %s='%s'",
 		s.serverConf.Mysql.Table,
+		strings.Join(names, "=?, "),
+		s.schema.Column("username"),
 		user.Username)
 	if err != nil {
 		logrus.Errorf("Build SQL string(%s) error %+v when Update User(%+v)", query.String(), err, user)
@@ -129,7 +250,7 @@ func (s *SubService) UpdateUser(user *User) error {
 	}
 	defer stmt.Close()
 
-	res, err := stmt.ExecContext(ctx, user.Username, user.Domain, user.Password, user.EmailAddress, user.Ha1, user.Ha1b)
+	res, err := stmt.ExecContext(ctx, fieldValues(fields)...)
 	if err != nil {
 		logrus.Errorf("Exec SQL statement(%s) error %+v when Update User(%+v)", query.String(), err, user)
 		return err
@@ -141,6 +262,7 @@ func (s *SubService) UpdateUser(user *User) error {
 		return err
 	}
 	logrus.Infof("%d rows affected when Update User (%+v)", rows, user)
+	s.flushLocation(user)
 	return nil
 }
 
@@ -150,8 +272,8 @@ func (s *SubService) DeleteUser(username string) error {
 		return err
 	}
 	var query strings.Builder
-	_, err = fmt.Fprintf(&query, "DELETE from %s where username=?",
-		s.serverConf.Mysql.Table)
+	_, err = fmt.Fprintf(&query, "DELETE from %s where %s=?",
+		s.serverConf.Mysql.Table, s.schema.Column("username"))
 	if err != nil {
 		logrus.Errorf("Build SQL string(%s) error %+v when Delete User(%s)", query.String(), err, username)
 		return err
@@ -176,6 +298,7 @@ func (s *SubService) DeleteUser(username string) error {
 		return err
 	}
 	logrus.Infof("%d rows affected when Delete User (%s)", rows, username)
+	s.flushLocation(&User{Username: username, Domain: s.serverConf.Opensips.Domain})
 	return nil
 }
 
@@ -185,10 +308,12 @@ func (s *SubService) GetUser(username string) (*User, error, bool) {
 	if err != nil {
 		return nil, err, false
 	}
+	var user User
+	names, fields := s.userFields(&user, false)
 	var query strings.Builder
 	_, err = fmt.Fprintf(&query,
-		"select username,domain,password,email_address,ha1,ha1b from %s where username = '%s'",
-		s.serverConf.Mysql.Table, username)
+		"select %s from %s where %s = '%s'",
+		strings.Join(names, ","), s.serverConf.Mysql.Table, s.schema.Column("username"), username)
 	if err != nil {
 		logrus.Errorf("Build SQL string(%s) error %+v when Select User(%s)", query.String(), err, username)
 		return nil, err, false
@@ -203,12 +328,12 @@ func (s *SubService) GetUser(username string) (*User, error, bool) {
 	}
 	defer stmt.Close()
 
-	var user User
 	row := stmt.QueryRowContext(ctx)
-	if err := row.Scan(&user.Username, &user.Domain, &user.Password, &user.EmailAddress, &user.Ha1, &user.Ha1b); err != nil {
+	if err := row.Scan(fields...); err != nil {
 		logrus.Errorf("Error %+v when ROW Scan SQL statement(%s)", err, username)
 		return nil, err, true //user not found
 	}
+	user.Realm = s.schema.Realm()
 	logrus.Infof("select User(%s) success: %+v", username, user)
 	return &user, nil, true //user existed
 }
@@ -0,0 +1,146 @@
+package opensips
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"jingxi.cn/transitservice/utils"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	minExpires        = 60
+	maxExpires        = 86400
+	minSessionExpires = 90 //Min-SE of RFC 4028
+)
+
+var sipTransports = []string{"udp", "tcp", "tls"}
+
+//strict decode of sip.json, unknown fields and invalid values are errors
+func ParseSipIceTemplate(data []byte) (*SipIceConfig, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var c SipIceConfig
+	if err := decoder.Decode(&c); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+//values a client could register with, credentials and servers are filled in later
+func (s *SipIceConfig) Validate() error {
+	if len(s.Sip.Auth) < 1 {
+		return errors.New("sip.auth is empty")
+	}
+	if len(s.Sip.Proxy) < 1 {
+		return errors.New("sip.proxy is empty")
+	}
+	for k, v := range s.Sip.Proxy {
+		if v.Expires < minExpires || v.Expires > maxExpires {
+			return fmt.Errorf("sip.proxy[%d].expires %d out of range %d-%d", k, v.Expires, minExpires, maxExpires)
+		}
+	}
+	if s.Sip.SessionExpires != 0 && (s.Sip.SessionExpires < minSessionExpires || s.Sip.SessionExpires > maxExpires) {
+		return fmt.Errorf("sip.session_expires %d out of range %d-%d", s.Sip.SessionExpires, minSessionExpires, maxExpires)
+	}
+	if s.Sip.MaxCalls < 0 {
+		return fmt.Errorf("sip.max_calls %d is negative", s.Sip.MaxCalls)
+	}
+	if len(s.Sip.Transport) > 0 {
+		valid := false
+		for _, v := range sipTransports {
+			valid = valid || strings.EqualFold(v, s.Sip.Transport)
+		}
+		if !valid {
+			return fmt.Errorf("sip.transport %s is not one of %s", s.Sip.Transport, strings.Join(sipTransports, ", "))
+		}
+	}
+	return nil
+}
+
+//sip.json edited by admin api, every save is kept as a revision
+type TemplateStore struct {
+	file      string
+	revisions *utils.RevisionStore
+	mu        sync.Mutex
+}
+
+func NewTemplateStore(file string, dir string) *TemplateStore {
+	return &TemplateStore{
+		file:      file,
+		revisions: utils.NewRevisionStore(dir),
+	}
+}
+
+func (s *TemplateStore) Current() ([]byte, error) {
+	return ioutil.ReadFile(s.file)
+}
+
+//oldest first, without content
+func (s *TemplateStore) Revisions() ([]*utils.Revision, error) {
+	return s.revisions.List()
+}
+
+//utils.ErrRevisionNotFound if not found
+func (s *TemplateStore) Revision(id int) (*utils.Revision, error) {
+	revision, err := s.revisions.Get(id)
+	if err == nil && revision == nil {
+		err = utils.ErrRevisionNotFound
+	}
+	return revision, err
+}
+
+//validate content, write it to sip.json and keep it as a revision
+func (s *TemplateStore) Save(content []byte, author string, comment string) (*utils.Revision, *SipIceConfig, error) {
+	template, err := ParseSipIceTemplate(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, err := ioutil.ReadFile(s.file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	//template written before admin api is the first revision, so it can be rolled back to
+	latest, err := s.revisions.Latest()
+	if err != nil {
+		return nil, nil, err
+	}
+	if latest == nil && old != nil {
+		if _, err = s.revisions.Add(utils.FileAuthor, "before admin api", old); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err = utils.SaveJsonFile(s.file, json.RawMessage(content)); err != nil {
+		return nil, nil, err
+	}
+	revision, err := s.revisions.Add(author, comment, content)
+	if err != nil {
+		if old != nil {
+			_ = utils.SaveJsonFile(s.file, json.RawMessage(old))
+		}
+		return nil, nil, err
+	}
+	revision.Content = nil
+	logrus.Infof("sip template %s saved as revision %d by %s", s.file, revision.Id, author)
+	return revision, template, nil
+}
+
+//save content of revision id again as the latest revision
+func (s *TemplateStore) Rollback(id int, author string) (*utils.Revision, *SipIceConfig, error) {
+	revision, err := s.Revision(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.Save(revision.Content, author, fmt.Sprintf("rollback to revision %d", id))
+}
@@ -22,43 +22,78 @@ CREATE TABLE `subscriber`  (
 ) ENGINE = InnoDB AUTO_INCREMENT = 90 CHARACTER SET = latin1 COLLATE = latin1_swedish_ci ROW_FORMAT = Dynamic;
 
 SET FOREIGN_KEY_CHECKS = 1;
+
+OpenSIPS 3.x (RFC 8760) adds:
+  `ha1_sha256` char(64) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL DEFAULT '',
+  `ha1_sha512t256` char(64) CHARACTER SET latin1 COLLATE latin1_swedish_ci NOT NULL DEFAULT '',
+and drops email_address, ha1b and rpid
 */
 
 //opensips User object
 type User struct {
-	Username     string
-	Domain       string
-	Password     string
-	EmailAddress string
-	Ha1          string
-	Ha1b         string
-	Rpid         string
+	Username      string
+	Domain        string
+	Password      string
+	EmailAddress  string
+	Ha1           string
+	Ha1b          string
+	Ha1Sha256     string
+	Ha1Sha512t256 string
+	Rpid          string
+	Realm         string //auth realm of hashes, not stored, empty is Domain
+}
+
+//optional digest hash columns the subscriber table actually has
+type HashColumns struct {
+	Ha1b          bool
+	Ha1Sha256     bool
+	Ha1Sha512t256 bool
 }
 
 //make a new User object from domain,username, password
 func NewUser(domain string, user string, password string) *User {
 	newUser := &User{
-		Username:     user,
-		Domain:       domain,
-		Password:     password,
-		EmailAddress: "",
-		Ha1:          "",
-		Ha1b:         "",
-		Rpid:         "",
+		Username:      user,
+		Domain:        domain,
+		Password:      password,
+		EmailAddress:  "",
+		Ha1:           "",
+		Ha1b:          "",
+		Ha1Sha256:     "",
+		Ha1Sha512t256: "",
+		Rpid:          "",
 	}
 	if len(password) < 1 {
 		//we use long password
 		newUser.Password = utils.RandString(16)
 	}
-	newUser.Ha1 = GetHa1(newUser)
-	newUser.Ha1b = GetHa1b(newUser)
+	newUser.updateHashes()
 	return newUser
 }
 
 func (u *User) SetPassword(password string) {
 	u.Password = password
+	u.updateHashes()
+}
+
+//kamailio auth realm may differ from the domain column
+func (u *User) SetRealm(realm string) {
+	u.Realm = realm
+	u.updateHashes()
+}
+
+func (u *User) realm() string {
+	if len(u.Realm) > 0 {
+		return u.Realm
+	}
+	return u.Domain
+}
+
+func (u *User) updateHashes() {
 	u.Ha1 = GetHa1(u)
 	u.Ha1b = GetHa1b(u)
+	u.Ha1Sha256 = GetHa1Sha256(u)
+	u.Ha1Sha512t256 = GetHa1Sha512t256(u)
 }
 
 //md5('did_cid_sn')
@@ -72,32 +107,47 @@ func CreateUserId(did string, cid string, sn string) string {
 	return utils.Md5String(builder.String())
 }
 
-//md5('username:domain:password')
-func GetHa1(user *User) string {
+//'username:realm:password', realm is domain if not set
+func ha1Source(user *User) string {
 	var builder strings.Builder
 	builder.WriteString(user.Username)
 	builder.WriteByte(':')
-	builder.WriteString(user.Domain)
+	builder.WriteString(user.realm())
 	builder.WriteByte(':')
 	builder.WriteString(user.Password)
-	return utils.Md5String(builder.String())
+	return builder.String()
 }
 
-//md5('username@domain:domain:password')
+//md5('username:domain:password')
+func GetHa1(user *User) string {
+	return utils.Md5String(ha1Source(user))
+}
+
+//sha256('username:domain:password'), RFC 8760
+func GetHa1Sha256(user *User) string {
+	return utils.Sha256String(ha1Source(user))
+}
+
+//sha512-256('username:domain:password'), RFC 8760
+func GetHa1Sha512t256(user *User) string {
+	return utils.Sha512t256String(ha1Source(user))
+}
+
+//md5('username@domain:realm:password')
 func GetHa1b(user *User) string {
 	var builder strings.Builder
 	builder.WriteString(user.Username)
 	builder.WriteByte('@')
 	builder.WriteString(user.Domain)
 	builder.WriteByte(':')
-	builder.WriteString(user.Domain)
+	builder.WriteString(user.realm())
 	builder.WriteByte(':')
 	builder.WriteString(user.Password)
 	return utils.Md5String(builder.String())
 }
 
-//check user in database is valid
-func IsUserValid(user *User, domain string) bool {
+//check user in database is valid, only hash columns the table has are compared
+func IsUserValid(user *User, domain string, columns HashColumns) bool {
 	if len(user.Password) < 1 {
 		return false
 	}
@@ -110,7 +160,13 @@ func IsUserValid(user *User, domain string) bool {
 	if !strings.EqualFold(user.Ha1, ha1) {
 		return false
 	}
-	if !strings.EqualFold(user.Ha1b, hab1) {
+	if columns.Ha1b && !strings.EqualFold(user.Ha1b, hab1) {
+		return false
+	}
+	if columns.Ha1Sha256 && !strings.EqualFold(user.Ha1Sha256, GetHa1Sha256(user)) {
+		return false
+	}
+	if columns.Ha1Sha512t256 && !strings.EqualFold(user.Ha1Sha512t256, GetHa1Sha512t256(user)) {
 		return false
 	}
 	return true
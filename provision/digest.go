@@ -0,0 +1,130 @@
+package provision
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"jingxi.cn/transitservice/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const nonceLifetime = 5 * time.Minute
+
+//RFC 2617 digest auth (MD5, qop=auth) for provisioning download
+type DigestAuth struct {
+	realm    string
+	username string
+	password string
+	secret   []byte //nonce signing key
+}
+
+func NewDigestAuth(realm string, username string, password string) *DigestAuth {
+	if len(realm) < 1 {
+		realm = "provisioning"
+	}
+	return &DigestAuth{
+		realm:    realm,
+		username: username,
+		password: password,
+		secret:   []byte(utils.RandString(32)),
+	}
+}
+
+//nonce: unixtime:hmac(unixtime), verifiable without server state
+func (d *DigestAuth) createNonce(t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return ts + ":" + d.sign(ts)
+}
+
+func (d *DigestAuth) sign(ts string) string {
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write([]byte(ts))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *DigestAuth) isNonceValid(nonce string) bool {
+	pos := strings.IndexByte(nonce, ':')
+	if pos < 0 {
+		return false
+	}
+	ts := nonce[:pos]
+	if !hmac.Equal([]byte(nonce[pos+1:]), []byte(d.sign(ts))) {
+		return false
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Since(time.Unix(sec, 0)) < nonceLifetime
+}
+
+//value of WWW-Authenticate header
+func (d *DigestAuth) Challenge() string {
+	return fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=MD5, nonce="%s"`,
+		d.realm, d.createNonce(time.Now()))
+}
+
+//parse `Digest k1="v1", k2=v2`
+func parseDigest(header string) map[string]string {
+	if !strings.HasPrefix(header, "Digest ") {
+		return nil
+	}
+	params := make(map[string]string)
+	for _, part := range splitParams(header[len("Digest "):]) {
+		pos := strings.IndexByte(part, '=')
+		if pos < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(part[:pos]))
+		params[key] = strings.Trim(strings.TrimSpace(part[pos+1:]), `"`)
+	}
+	return params
+}
+
+//split by comma outside of quotes
+func splitParams(s string) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func (d *DigestAuth) Check(req *http.Request) bool {
+	params := parseDigest(req.Header.Get("Authorization"))
+	if params == nil {
+		return false
+	}
+	if params["username"] != d.username || params["realm"] != d.realm {
+		return false
+	}
+	if !d.isNonceValid(params["nonce"]) {
+		return false
+	}
+	if params["uri"] != req.URL.RequestURI() {
+		return false
+	}
+	ha1 := utils.Md5String(d.username + ":" + d.realm + ":" + d.password)
+	ha2 := utils.Md5String(req.Method + ":" + params["uri"])
+	var expected string
+	if len(params["qop"]) > 0 {
+		expected = utils.Md5String(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2}, ":"))
+	} else {
+		expected = utils.Md5String(ha1 + ":" + params["nonce"] + ":" + ha2)
+	}
+	return hmac.Equal([]byte(expected), []byte(params["response"]))
+}
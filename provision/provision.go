@@ -0,0 +1,157 @@
+package provision
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+const (
+	VendorYealink     = "yealink"
+	VendorGrandstream = "grandstream"
+)
+
+var macPattern = regexp.MustCompile(`^[0-9a-f]{12}$`)
+
+//Yealink UA: Yealink SIP-T46U 108.86.0.20 80:5e:c0:11:22:33
+//Grandstream UA: Grandstream Model HW GXP2170 SW 1.0.11.3 DevId 000b82112233
+var modelPatterns = map[string]*regexp.Regexp{
+	VendorYealink:     regexp.MustCompile(`(?i)yealink\s+(?:SIP[-\s])?([A-Za-z0-9]+)`),
+	VendorGrandstream: regexp.MustCompile(`(?i)grandstream\s+model\s+HW\s+([A-Za-z0-9]+)`),
+}
+
+//phone provisioning file request
+type Request struct {
+	Vendor string
+	Mac    string //lower case, no separator
+	Model  string //from User-Agent, may be empty
+}
+
+//values which provisioning templates can use
+type Account struct {
+	Mac         string
+	Model       string
+	Username    string
+	Password    string
+	DisplayName string
+	Domain      string
+	SipHost     string
+	SipPort     string
+	Transport   string
+	Expires     int //seconds
+	StunServer  string
+	TurnServer  string
+}
+
+//<mac>.cfg is Yealink, cfg<mac>.xml is Grandstream
+func ParseFileName(file string, userAgent string) (*Request, error) {
+	name := strings.ToLower(file)
+	var r Request
+	switch {
+	case strings.HasPrefix(name, "cfg") && strings.HasSuffix(name, ".xml"):
+		r.Vendor = VendorGrandstream
+		r.Mac = strings.TrimSuffix(strings.TrimPrefix(name, "cfg"), ".xml")
+	case strings.HasSuffix(name, ".cfg"):
+		r.Vendor = VendorYealink
+		r.Mac = strings.TrimSuffix(name, ".cfg")
+	default:
+		return nil, errors.New("unknown provisioning file")
+	}
+	if !macPattern.MatchString(r.Mac) {
+		return nil, errors.New("invalid mac address")
+	}
+	if m := modelPatterns[r.Vendor].FindStringSubmatch(userAgent); len(m) > 1 {
+		r.Model = strings.ToUpper(m[1])
+	}
+	return &r, nil
+}
+
+//<dir>/<vendor>_<model>.tmpl first, then <dir>/<vendor>.tmpl, then the builtin template
+func LoadTemplate(dir string, r *Request) (*template.Template, error) {
+	var names []string
+	if len(r.Model) > 0 {
+		names = append(names, r.Vendor+"_"+strings.ToLower(r.Model)+".tmpl")
+	}
+	names = append(names, r.Vendor+".tmpl")
+	for _, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			return newTemplate(name, string(data))
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return newTemplate(r.Vendor, builtinTemplates[r.Vendor])
+}
+
+func newTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(template.FuncMap{"xml": escapeXml, "minutes": minutes}).Parse(text)
+}
+
+func escapeXml(s string) string {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+//round up, grandstream register expiration is in minutes
+func minutes(seconds int) int {
+	return (seconds + 59) / 60
+}
+
+func Render(t *template.Template, account *Account) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, account); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func ContentType(vendor string) string {
+	if vendor == VendorGrandstream {
+		return "application/xml; charset=utf-8"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+var builtinTemplates = map[string]string{
+	VendorYealink: `#!version:1.0.0.1
+account.1.enable = 1
+account.1.label = {{.DisplayName}}
+account.1.display_name = {{.DisplayName}}
+account.1.auth_name = {{.Username}}
+account.1.user_name = {{.Username}}
+account.1.password = {{.Password}}
+account.1.sip_server.1.address = {{.SipHost}}
+account.1.sip_server.1.port = {{.SipPort}}
+account.1.sip_server.1.expires = {{.Expires}}
+account.1.sip_server.1.transport_type = {{if eq .Transport "tcp"}}1{{else if eq .Transport "tls"}}2{{else}}0{{end}}
+account.1.nat.nat_traversal = {{if .StunServer}}1{{else}}0{{end}}
+sip.nat_stun.enable = {{if .StunServer}}1{{else}}0{{end}}
+sip.nat_stun.server = {{.StunServer}}
+`,
+	VendorGrandstream: `<?xml version="1.0" encoding="UTF-8"?>
+<gs_provision version="1">
+  <mac>{{.Mac}}</mac>
+  <config version="1">
+    <P271>1</P271>
+    <P270>{{xml .DisplayName}}</P270>
+    <P47>{{xml .SipHost}}:{{xml .SipPort}}</P47>
+    <P35>{{xml .Username}}</P35>
+    <P36>{{xml .Username}}</P36>
+    <P34>{{xml .Password}}</P34>
+    <P3>{{xml .DisplayName}}</P3>
+    <P32>{{minutes .Expires}}</P32>
+    <P130>{{if eq .Transport "tcp"}}1{{else if eq .Transport "tls"}}2{{else}}0{{end}}</P130>
+    <P76>{{xml .StunServer}}</P76>
+  </config>
+</gs_provision>
+`,
+}
@@ -0,0 +1,174 @@
+package push
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"jingxi.cn/transitservice/conf"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//https://developer.apple.com/documentation/usernotifications/sending-notification-requests-to-apns
+
+const (
+	ProviderApns = "apns"
+
+	apnsProductionUrl = "https://api.push.apple.com"
+	//apple rejects tokens older than one hour and refreshing faster than 20 minutes
+	apnsTokenLifetime     = time.Hour
+	apnsTokenRefreshAhead = 10 * time.Minute //a token is used for 50 minutes
+)
+
+type ApnsPayload struct {
+	Aps             ApsField        `json:"aps"`
+	IntercomContent IntercomMessage `json:"intercomContent"` //mobile use this value
+}
+
+type apnsError struct {
+	Reason    string `json:"reason"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+//reasons mean the device token will never be valid again
+var apnsInvalidTokenReasons = map[string]bool{
+	"BadDeviceToken":         true,
+	"Unregistered":           true,
+	"DeviceTokenNotForTopic": true,
+}
+
+type ApnsProvider struct {
+	conf   conf.Apns
+	key    crypto.Signer
+	client *http.Client
+	token  tokenCache //provider token
+}
+
+func NewApnsProvider(c conf.Apns, keyData []byte) (*ApnsProvider, error) {
+	key, err := parsePrivateKey(keyData)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Url) < 1 {
+		c.Url = apnsProductionUrl
+	}
+	return &ApnsProvider{
+		conf: c,
+		key:  key,
+		client: &http.Client{
+			//http2 is negotiated by TLS ALPN
+			Transport: &http.Transport{ForceAttemptHTTP2: true},
+			Timeout:   10 * time.Second,
+		},
+		token: tokenCache{ahead: apnsTokenRefreshAhead},
+	}, nil
+}
+
+func (p *ApnsProvider) Name() string {
+	return ProviderApns
+}
+
+func (p *ApnsProvider) providerToken() (string, error) {
+	return p.token.get(func() (string, time.Duration, error) {
+		token, err := createJwt(p.conf.KeyId, map[string]interface{}{
+			"iss": p.conf.TeamId,
+			"iat": time.Now().Unix(),
+		}, p.key)
+		return token, apnsTokenLifetime, err
+	})
+}
+
+//topic of intercom scheme, the one without scheme is default
+func (p *ApnsProvider) topic(scheme string) conf.ApnsTopic {
+	topic := p.conf.Topics[0]
+	for _, v := range p.conf.Topics {
+		if strings.EqualFold(v.Scheme, scheme) {
+			return v
+		}
+		if len(v.Scheme) < 1 {
+			topic = v
+		}
+	}
+	return topic
+}
+
+func (p *ApnsProvider) Push(message *IntercomMessage) (*DeliveryResult, error) {
+	payload, err := json.Marshal(ApnsPayload{
+		Aps:             CreateApsField(message),
+		IntercomContent: *message,
+	})
+	if err != nil {
+		return nil, err
+	}
+	token, err := p.providerToken()
+	if err != nil {
+		return nil, err
+	}
+	topic := p.topic(message.Scheme)
+
+	req, err := http.NewRequest("POST", p.conf.Url+"/3/device/"+message.Device, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	pushType := topic.PushType
+	if len(pushType) < 1 {
+		pushType = "alert"
+	}
+	//message ttl is used when it is shorter than topic expiration
+	ttl := topic.Expiration
+	if message.Ttl > 0 && (ttl < 1 || message.Ttl < ttl) {
+		ttl = message.Ttl
+	}
+	expiration := "0"
+	if ttl > 0 {
+		expiration = strconv.FormatInt(time.Now().Add(time.Duration(ttl)*time.Second).Unix(), 10)
+	}
+	req.Header.Set("authorization", "bearer "+token)
+	req.Header.Set("apns-topic", topic.Topic)
+	req.Header.Set("apns-push-type", pushType)
+	req.Header.Set("apns-expiration", expiration)
+	if topic.Priority > 0 {
+		req.Header.Set("apns-priority", strconv.Itoa(topic.Priority))
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return p.parseResult(resp, body), nil
+}
+
+func (p *ApnsProvider) parseResult(resp *http.Response, body []byte) *DeliveryResult {
+	result := &DeliveryResult{
+		Provider: ProviderApns,
+		Success:  resp.StatusCode == http.StatusOK,
+		Code:     resp.StatusCode,
+		Raw:      string(body),
+	}
+	if result.Success {
+		result.Raw = fmt.Sprintf(`{"apns-id":"%s"}`, resp.Header.Get("apns-id"))
+		return result
+	}
+	var e apnsError
+	_ = json.Unmarshal(body, &e)
+	result.Reason = e.Reason
+	result.InvalidToken = apnsInvalidTokenReasons[e.Reason]
+	switch {
+	case e.Reason == "ExpiredProviderToken" || e.Reason == "InvalidProviderToken":
+		p.token.reset()
+		result.Retryable = true
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		result.Retryable = true
+	}
+	return result
+}
@@ -0,0 +1,76 @@
+package push
+
+import (
+	"encoding/json"
+	"jingxi.cn/transitservice/conf"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const apnsTestSend = "/3/device/token-1"
+
+func newTestApnsProvider(t *testing.T, serverUrl string) *ApnsProvider {
+	p, err := NewApnsProvider(conf.Apns{
+		Url:    serverUrl,
+		KeyId:  "key-id",
+		TeamId: "team-id",
+		Topics: []conf.ApnsTopic{
+			{Topic: "com.example.app"},
+			{Topic: "com.example.app.voip", Scheme: "call", PushType: "voip", Priority: 10},
+		},
+	}, newTestEcdsaKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestApnsPush(t *testing.T) {
+	runResultCases(t, ProviderApns, apnsTestSend, nil, []resultCase{
+		{"success", fakeReply{status: http.StatusOK, header: map[string]string{"apns-id": "id-1"}},
+			wantResult{success: true}},
+		{"unregistered", fakeReply{status: http.StatusGone, body: `{"reason":"Unregistered","timestamp":1700000000}`},
+			wantResult{invalidToken: true}},
+		{"bad device token", fakeReply{status: http.StatusBadRequest, body: `{"reason":"BadDeviceToken"}`},
+			wantResult{invalidToken: true}},
+		{"service unavailable", fakeReply{status: http.StatusServiceUnavailable, body: `{"reason":"ServiceUnavailable"}`},
+			wantResult{retryable: true}},
+		{"expired provider token", fakeReply{status: http.StatusForbidden, body: `{"reason":"ExpiredProviderToken"}`},
+			wantResult{retryable: true}},
+		//apns answers json, a proxy in between may not
+		{"unparsable body", fakeReply{status: http.StatusBadRequest, body: `<html>bad request</html>`},
+			wantResult{}},
+		{"unparsable server error", fakeReply{status: http.StatusBadGateway, body: `<html>bad gateway</html>`},
+			wantResult{retryable: true}},
+	}, func(serverUrl string) PushProvider {
+		return newTestApnsProvider(t, serverUrl)
+	})
+}
+
+func TestApnsRequest(t *testing.T) {
+	f := newFakePush(t, map[string]fakeReply{apnsTestSend: {status: http.StatusOK}})
+	p := newTestApnsProvider(t, f.URL)
+	message := newTestMessage()
+	message.Ttl = 30
+	result, err := p.Push(message)
+	if err != nil || !result.Success {
+		t.Fatalf("Push: %+v %v", result, err)
+	}
+	request := f.received(apnsTestSend)[0]
+	header := request.Header
+	if header.Get("apns-topic") != "com.example.app.voip" || header.Get("apns-push-type") != "voip" ||
+		header.Get("apns-priority") != "10" || header.Get("apns-expiration") == "0" {
+		t.Errorf("headers %v", header)
+	}
+	if !strings.HasPrefix(header.Get("authorization"), "bearer ") || strings.Count(header.Get("authorization"), ".") != 2 {
+		t.Errorf("authorization %s, want bearer jwt", header.Get("authorization"))
+	}
+	var payload ApnsPayload
+	if err = json.Unmarshal([]byte(request.Body), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Aps.AlertInfo.Title != "Door station" || payload.Aps.Sound != "default" || payload.IntercomContent.Cid != "cid-1" {
+		t.Errorf("payload %+v", payload)
+	}
+}
@@ -0,0 +1,422 @@
+package push
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"jingxi.cn/transitservice/conf"
+	"jingxi.cn/transitservice/registry"
+	"jingxi.cn/transitservice/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	BroadcastScheduled = "scheduled"
+	BroadcastSending   = "sending"
+	BroadcastDone      = "done"
+	BroadcastCanceled  = "canceled"
+
+	defaultBroadcastRate = 50
+
+	broadcastPollInterval = time.Second
+	broadcastSaveInterval = 5 * time.Second
+)
+
+//families of devices in community, empty buildings or units matches all
+//devices registered by firmware without room location have no community and are never matched
+type BroadcastTarget struct {
+	Community string   `json:"community"`
+	Buildings []string `json:"buildings"`
+	Units     []string `json:"units"`
+}
+
+func (t *BroadcastTarget) match(device *registry.Device) bool {
+	return len(device.FamilyId) > 0 && device.Community == t.Community &&
+		matchAny(t.Buildings, device.Building) && matchAny(t.Units, device.Unit)
+}
+
+func matchAny(values []string, value string) bool {
+	if len(values) < 1 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type BroadcastStats struct {
+	Families  int `json:"families"`  //families targeted
+	Done      int `json:"done"`      //families pushed
+	Progress  int `json:"progress"`  //percent of families pushed
+	NoTarget  int `json:"noTarget"`  //families without valid push token
+	Targets   int `json:"targets"`   //push tokens pushed to
+	Pending   int `json:"pending"`   //pushes waiting in queue
+	Delivered int `json:"delivered"` //push tokens delivered
+	Skipped   int `json:"skipped"`   //expired or held back by do-not-disturb
+	Failed    int `json:"failed"`    //failed after retries of queue
+}
+
+func (st *BroadcastStats) count(result *DeliveryResult) {
+	switch {
+	case result != nil && result.Success:
+		st.Delivered++
+	case result != nil && (result.Dropped || result.Suppressed):
+		st.Skipped++
+	default:
+		st.Failed++
+	}
+}
+
+//announcement to every family of target
+type Broadcast struct {
+	Id         string          `json:"id"`
+	Target     BroadcastTarget `json:"target"`
+	Message    IntercomMessage `json:"message"`
+	SendTime   int64           `json:"sendTime"` //unix milliseconds, 0 is now
+	Status     string          `json:"status"`
+	Stats      BroadcastStats  `json:"stats"`
+	Fids       []string        `json:"fids,omitempty"` //families resolved when sending starts
+	CreateTime int64           `json:"createTime"`
+	StartTime  int64           `json:"startTime"`
+	FinishTime int64           `json:"finishTime"`
+}
+
+//schedules broadcasts and enqueues them family by family at a limited rate
+//messages are prepared like /push ones and go through the push queue, so failed pushes are retried and dead-lettered
+//without queue they are pushed once by PushAll, deduplication of /push never applies
+//broadcasts are persisted as a json file, interrupted sending resumes after restart
+//progress is saved every broadcastSaveInterval, families pushed since the last save are pushed again after a crash
+type BroadcastService struct {
+	file       string
+	rate       int
+	service    *PushService
+	queue      *PushQueue                     //nil pushes directly
+	prepare    func(message *IntercomMessage) //keyword, derive and locale rules of /push
+	devices    *registry.DeviceRegistry
+	broadcasts map[string]*Broadcast
+	running    map[string]bool
+	dirty      bool //stats changed since last save
+	saveTime   time.Time
+	quit       chan struct{}
+	wg         sync.WaitGroup
+	rw         sync.RWMutex
+}
+
+func LoadBroadcastService(c conf.Broadcast, file string, service *PushService, devices *registry.DeviceRegistry) (*BroadcastService, error) {
+	if c.Rate < 1 {
+		c.Rate = defaultBroadcastRate
+	}
+	s := &BroadcastService{
+		file:       file,
+		rate:       c.Rate,
+		service:    service,
+		devices:    devices,
+		broadcasts: make(map[string]*Broadcast),
+		running:    make(map[string]bool),
+		quit:       make(chan struct{}),
+	}
+	var broadcasts []*Broadcast
+	_, err := utils.LoadJsonFile(file, &broadcasts)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range broadcasts {
+		s.broadcasts[v.Id] = v
+	}
+	return s, nil
+}
+
+func (s *BroadcastService) Start() {
+	s.wg.Add(1)
+	go s.schedule()
+}
+
+//sending broadcasts stop after current family and resume on next start
+func (s *BroadcastService) Stop() {
+	close(s.quit)
+	s.wg.Wait()
+	s.rw.Lock()
+	if s.dirty {
+		_ = s.save()
+	}
+	s.rw.Unlock()
+}
+
+//families are enqueued from now on, set before Start
+func (s *BroadcastService) SetQueue(queue *PushQueue) {
+	s.queue = queue
+}
+
+//every message resolved for a family is prepared before it is pushed, set before Start
+func (s *BroadcastService) SetPreparer(prepare func(message *IntercomMessage)) {
+	s.prepare = prepare
+}
+
+//outcome of a queued push, handler of PushQueue.SetFinishedHandler
+func (s *BroadcastService) JobFinished(job *Job) {
+	if len(job.Broadcast) < 1 {
+		return
+	}
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	b, ok := s.broadcasts[job.Broadcast]
+	if !ok {
+		return
+	}
+	if b.Stats.Pending > 0 {
+		b.Stats.Pending--
+	}
+	b.Stats.count(job.LastResult())
+	s.dirty = true
+}
+
+//broadcasts are pushed by service from now on, e.g. after configuration reload
+func (s *BroadcastService) SetService(service *PushService) {
+	s.rw.Lock()
+	s.service = service
+	s.rw.Unlock()
+}
+
+func (s *BroadcastService) Create(b *Broadcast) error {
+	if len(b.Target.Community) < 1 {
+		return errors.New("target community is required")
+	}
+	if len(b.Message.Title) < 1 && len(b.Message.Body) < 1 {
+		return errors.New("message title or body is required")
+	}
+	b.Id = newJobId()
+	b.Status = BroadcastScheduled
+	b.Stats = BroadcastStats{}
+	b.Fids = nil
+	b.CreateTime = nowMillis()
+	b.StartTime = 0
+	b.FinishTime = 0
+	if b.SendTime < b.CreateTime {
+		b.SendTime = b.CreateTime
+	}
+
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	s.broadcasts[b.Id] = b
+	return s.save()
+}
+
+//cancel scheduled or sending broadcast
+func (s *BroadcastService) Cancel(id string) error {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	b, ok := s.broadcasts[id]
+	if !ok {
+		return errors.New("broadcast not found")
+	}
+	if b.Status != BroadcastScheduled && b.Status != BroadcastSending {
+		return errors.New("broadcast is " + b.Status)
+	}
+	b.Status = BroadcastCanceled
+	b.FinishTime = nowMillis()
+	return s.save()
+}
+
+//nil if not found, returned broadcast is a copy without resolved families
+func (s *BroadcastService) Get(id string) *Broadcast {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	if v, ok := s.broadcasts[id]; ok {
+		b := *v
+		b.Fids = nil
+		return &b
+	}
+	return nil
+}
+
+//newest first
+func (s *BroadcastService) List() []*Broadcast {
+	s.rw.RLock()
+	broadcasts := make([]*Broadcast, 0, len(s.broadcasts))
+	for _, v := range s.broadcasts {
+		b := *v
+		b.Fids = nil
+		broadcasts = append(broadcasts, &b)
+	}
+	s.rw.RUnlock()
+	sort.Slice(broadcasts, func(i, j int) bool {
+		return broadcasts[i].CreateTime > broadcasts[j].CreateTime
+	})
+	return broadcasts
+}
+
+func (s *BroadcastService) schedule() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(broadcastPollInterval)
+	defer ticker.Stop()
+	for {
+		for _, b := range s.dueBroadcasts() {
+			s.wg.Add(1)
+			go s.send(b)
+		}
+		s.rw.Lock()
+		if s.dirty && time.Since(s.saveTime) >= broadcastSaveInterval {
+			_ = s.save()
+		}
+		s.rw.Unlock()
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *BroadcastService) dueBroadcasts() []*Broadcast {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	now := nowMillis()
+	var broadcasts []*Broadcast
+	for id, b := range s.broadcasts {
+		if s.running[id] {
+			continue
+		}
+		if (b.Status == BroadcastScheduled && b.SendTime <= now) || b.Status == BroadcastSending {
+			s.running[id] = true
+			broadcasts = append(broadcasts, b)
+		}
+	}
+	return broadcasts
+}
+
+//families of target, sorted to resume at the same place
+func (s *BroadcastService) resolve(target BroadcastTarget) []string {
+	devices := s.devices.Find(target.match)
+	found := make(map[string]bool)
+	fids := make([]string, 0)
+	for _, v := range devices {
+		if !found[v.FamilyId] {
+			found[v.FamilyId] = true
+			fids = append(fids, v.FamilyId)
+		}
+	}
+	sort.Strings(fids)
+	return fids
+}
+
+func (s *BroadcastService) send(b *Broadcast) {
+	defer s.wg.Done()
+	defer func() {
+		s.rw.Lock()
+		delete(s.running, b.Id)
+		s.rw.Unlock()
+	}()
+
+	s.rw.Lock()
+	if b.Status == BroadcastScheduled {
+		b.Status = BroadcastSending
+		b.StartTime = nowMillis()
+		b.Fids = s.resolve(b.Target)
+		b.Stats.Families = len(b.Fids)
+		_ = s.save()
+	}
+	s.rw.Unlock()
+	logrus.Infof("broadcast(%s) to %d families of %s, %d done", b.Id, b.Stats.Families, b.Target.Community, b.Stats.Done)
+
+	for {
+		s.rw.RLock()
+		status, done := b.Status, b.Stats.Done
+		s.rw.RUnlock()
+		if status != BroadcastSending {
+			return
+		}
+		if done >= len(b.Fids) {
+			break
+		}
+		count := s.sendFamily(b, b.Fids[done])
+		//throttle fan-out to rate pushes per second
+		select {
+		case <-time.After(time.Duration(count) * time.Second / time.Duration(s.rate)):
+		case <-s.quit:
+			return
+		}
+	}
+
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	b.Status = BroadcastDone
+	b.Stats.Progress = 100
+	b.FinishTime = nowMillis()
+	_ = s.save()
+	logrus.Infof("broadcast(%s) done, %d delivered %d failed %d pending", b.Id, b.Stats.Delivered, b.Stats.Failed, b.Stats.Pending)
+}
+
+//push to every token of family, returns count of tokens pushed to
+func (s *BroadcastService) sendFamily(b *Broadcast, fid string) int {
+	message := b.Message
+	message.Device = ""
+	message.User = ""
+	message.Fid = fid
+	message.CreateTime = float64(nowMillis())
+	s.rw.RLock()
+	service := s.service
+	s.rw.RUnlock()
+	messages, err := service.Resolve(&message)
+	if err != nil {
+		s.rw.Lock()
+		defer s.rw.Unlock()
+		b.Stats.NoTarget++
+		s.familyDone(b)
+		return 0
+	}
+	if s.prepare != nil {
+		for _, m := range messages {
+			s.prepare(m)
+		}
+	}
+
+	var results []*DeliveryResult
+	if s.queue != nil {
+		//counted before enqueue, a job may finish before it returns
+		s.rw.Lock()
+		b.Stats.Pending += len(messages)
+		s.rw.Unlock()
+		if _, _, err = s.queue.EnqueueBroadcast(b.Id, messages); err != nil {
+			logrus.Errorf("broadcast(%s) enqueue family %s error: %+v", b.Id, fid, err)
+		}
+	} else {
+		results = service.PushAll(messages)
+	}
+
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	b.Stats.Targets += len(messages)
+	if err != nil {
+		b.Stats.Pending -= len(messages)
+		b.Stats.Failed += len(messages)
+	}
+	for _, v := range results {
+		b.Stats.count(v)
+	}
+	s.familyDone(b)
+	return len(messages)
+}
+
+func (s *BroadcastService) familyDone(b *Broadcast) {
+	b.Stats.Done++
+	b.Stats.Progress = b.Stats.Done * 100 / len(b.Fids)
+	s.dirty = true
+}
+
+func (s *BroadcastService) save() error {
+	broadcasts := make([]*Broadcast, 0, len(s.broadcasts))
+	for _, v := range s.broadcasts {
+		broadcasts = append(broadcasts, v)
+	}
+	err := utils.SaveJsonFile(s.file, broadcasts)
+	s.dirty = err != nil
+	s.saveTime = time.Now()
+	if err != nil {
+		logrus.Errorf("save broadcasts(%s) error: %+v", s.file, err)
+	}
+	return err
+}
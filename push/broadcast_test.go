@@ -0,0 +1,94 @@
+package push
+
+import (
+	"jingxi.cn/transitservice/conf"
+	"jingxi.cn/transitservice/registry"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBroadcastThroughQueue(t *testing.T) {
+	dir := t.TempDir()
+	f := newFakePush(t, map[string]fakeReply{
+		yunxinTestBatch: {status: http.StatusOK, body: `{"code":200}`},
+		yunxinTestSend:  {status: http.StatusOK, body: `{"code":404,"desc":"account not found"}`},
+	})
+	c := newTestYunxinConf(f.URL)
+	service := &PushService{serverConf: c, providers: make(map[string]PushProvider)}
+	service.AddProvider(NewYunxinProvider(c))
+	tokens, err := registry.LoadTokenRegistry(filepath.Join(dir, "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []*registry.PushToken{
+		{Id: "install-1", Provider: ProviderYunxin, Token: "token-1", UserId: "user-1", FamilyId: "fid-1"},
+		{Id: "install-2", Provider: ProviderYunxin, Token: "token-2", UserId: "user-2", FamilyId: "fid-1"},
+		{Id: "install-3", Provider: ProviderYunxin, Token: "token-3", UserId: "user-3", FamilyId: "fid-2"},
+	} {
+		if err = tokens.Register(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	service.SetTokenRegistry(tokens)
+	devices, err := registry.LoadDeviceRegistry(filepath.Join(dir, "devices.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []*registry.Device{
+		{Username: "door-1", FamilyId: "fid-1", Community: "c-1"},
+		{Username: "door-2", FamilyId: "fid-2", Community: "c-1"},
+		{Username: "door-3", FamilyId: "fid-3", Community: "c-2"},
+	} {
+		if err = devices.Update(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queue, err := NewPushQueue(conf.Queue{MaxAttempts: 1}, filepath.Join(dir, "queue"), service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failed []*Job
+	queue.SetFailedHandler(func(job *Job) {
+		failed = append(failed, job)
+	})
+	broadcasts, err := LoadBroadcastService(conf.Broadcast{Rate: 1000}, filepath.Join(dir, "broadcasts.json"), service, devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broadcasts.SetQueue(queue)
+	queue.SetFinishedHandler(broadcasts.JobFinished)
+	broadcasts.SetPreparer(func(message *IntercomMessage) {
+		message.Title = "prepared"
+	})
+	queue.Start()
+	broadcasts.Start()
+
+	b := &Broadcast{Target: BroadcastTarget{Community: "c-1"}, Message: IntercomMessage{Title: "water outage"}}
+	if err = broadcasts.Create(b); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := broadcasts.Get(b.Id)
+		if got.Status == BroadcastDone && got.Stats.Pending == 0 {
+			b = got
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("broadcast %+v not finished", got)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	broadcasts.Stop()
+	queue.Stop()
+
+	if b.Stats.Families != 2 || b.Stats.Targets != 3 || b.Stats.Delivered != 2 || b.Stats.Failed != 1 {
+		t.Errorf("stats %+v, want 2 families, 3 targets, 2 delivered and 1 failed", b.Stats)
+	}
+	if len(failed) != 1 || failed[0].Message.Device != "token-3" || failed[0].Message.Title != "prepared" {
+		t.Errorf("failed jobs %+v, want prepared push to token-3", failed)
+	}
+}
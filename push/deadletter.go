@@ -0,0 +1,187 @@
+package push
+
+import (
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"jingxi.cn/transitservice/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//push which exhausted retries or failed permanently, kept for inspection and replay
+type DeadLetter struct {
+	Id         string            `json:"id"`
+	MessageId  string            `json:"messageId"`
+	Message    IntercomMessage   `json:"message"`
+	Content    map[string]string `json:"content,omitempty"` //rendered provider content, e.g. yunxin attach and payload
+	Response   *DeliveryResult   `json:"response,omitempty"`
+	Attempts   []Attempt         `json:"attempts"`
+	CreateTime int64             `json:"createTime"` //unix milliseconds
+}
+
+//empty field matches any
+type DeadLetterFilter struct {
+	Device string
+	Fid    string
+	Code   int
+}
+
+func (f *DeadLetterFilter) match(letter *DeadLetter) bool {
+	if len(f.Device) > 0 && f.Device != letter.Message.Device {
+		return false
+	}
+	if len(f.Fid) > 0 && f.Fid != letter.Message.Fid {
+		return false
+	}
+	if f.Code != 0 && (letter.Response == nil || letter.Response.Code != f.Code) {
+		return false
+	}
+	return true
+}
+
+//dead letters stored as <dir>/<id>.json
+type DeadLetterStore struct {
+	dir     string
+	letters map[string]*DeadLetter
+	rw      sync.RWMutex
+}
+
+func LoadDeadLetterStore(dir string) (*DeadLetterStore, error) {
+	s := &DeadLetterStore{
+		dir:     dir,
+		letters: make(map[string]*DeadLetter),
+	}
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		var letter DeadLetter
+		_, err = utils.LoadJsonFile(filepath.Join(dir, f.Name()), &letter)
+		if err != nil {
+			logrus.Errorf("load dead letter(%s) error: %+v", f.Name(), err)
+			continue
+		}
+		s.letters[letter.Id] = &letter
+	}
+	return s, nil
+}
+
+//job id is kept as dead letter id
+func (s *DeadLetterStore) Add(job *Job, content map[string]string) error {
+	letter := &DeadLetter{
+		Id:         job.Id,
+		MessageId:  job.MessageId,
+		Message:    job.Message,
+		Content:    content,
+		Response:   job.LastResult(),
+		Attempts:   job.Attempts,
+		CreateTime: nowMillis(),
+	}
+	err := utils.SaveJsonFile(filepath.Join(s.dir, letter.Id+".json"), letter)
+	if err != nil {
+		logrus.Errorf("save dead letter(%s) error: %+v", letter.Id, err)
+		return err
+	}
+	s.rw.Lock()
+	s.letters[letter.Id] = letter
+	s.rw.Unlock()
+	return nil
+}
+
+//record a replay of letter which failed again, its response becomes the result if provider was reached
+func (s *DeadLetterStore) AddAttempt(id string, result *DeliveryResult, err error) error {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	old, ok := s.letters[id]
+	if !ok {
+		return os.ErrNotExist
+	}
+	//letters returned by Get are not modified
+	letter := *old
+	attempt := Attempt{Time: nowMillis(), Result: result}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	letter.Attempts = append(append([]Attempt{}, old.Attempts...), attempt)
+	if result != nil {
+		letter.Response = result
+	}
+	if e := utils.SaveJsonFile(filepath.Join(s.dir, id+".json"), &letter); e != nil {
+		logrus.Errorf("save dead letter(%s) error: %+v", id, e)
+		return e
+	}
+	s.letters[id] = &letter
+	return nil
+}
+
+//nil if not found
+func (s *DeadLetterStore) Get(id string) *DeadLetter {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	return s.letters[id]
+}
+
+//oldest first
+func (s *DeadLetterStore) List(filter DeadLetterFilter) []*DeadLetter {
+	s.rw.RLock()
+	letters := make([]*DeadLetter, 0)
+	for _, v := range s.letters {
+		if filter.match(v) {
+			letters = append(letters, v)
+		}
+	}
+	s.rw.RUnlock()
+	sort.Slice(letters, func(i, j int) bool {
+		if letters[i].CreateTime == letters[j].CreateTime {
+			return letters[i].Id < letters[j].Id
+		}
+		return letters[i].CreateTime < letters[j].CreateTime
+	})
+	return letters
+}
+
+func (s *DeadLetterStore) Remove(id string) error {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	return s.remove(id)
+}
+
+func (s *DeadLetterStore) remove(id string) error {
+	if _, ok := s.letters[id]; !ok {
+		return nil
+	}
+	err := os.Remove(filepath.Join(s.dir, id+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(s.letters, id)
+	return nil
+}
+
+//remove letters matched filter, returns count removed
+func (s *DeadLetterStore) Purge(filter DeadLetterFilter) (int, error) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	count := 0
+	for id, v := range s.letters {
+		if !filter.match(v) {
+			continue
+		}
+		if err := s.remove(id); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,60 @@
+package push
+
+import "strings"
+
+//title and body keys derived from raw intercom fields of old firmware
+//empty condition matches any, empty title is scheme and empty body is cmd
+type DeriveRule struct {
+	Scheme string `json:"scheme"`
+	Cmd    string `json:"cmd"`
+	Ack    *bool  `json:"ack,omitempty"`
+	Failed *bool  `json:"failed,omitempty"` //result is not 0
+	Title  string `json:"title"`
+	Body   string `json:"body"`
+}
+
+func boolPtr(v bool) *bool {
+	return &v
+}
+
+//rules of legacy MakePostData
+var defaultDeriveRules = []DeriveRule{
+	{Scheme: "icom", Cmd: "call", Ack: boolPtr(false), Body: "indoorcall"},
+	{Scheme: "icom", Cmd: "call", Ack: boolPtr(true), Failed: boolPtr(true), Body: "callout_failed"},
+	{Scheme: "icom", Cmd: "call", Ack: boolPtr(true), Failed: boolPtr(false), Body: "callout_success"},
+	{Cmd: "switch", Body: "security_switch"},
+}
+
+func (r *DeriveRule) match(message *IntercomMessage) bool {
+	if len(r.Scheme) > 0 && !strings.EqualFold(r.Scheme, message.Scheme) {
+		return false
+	}
+	if len(r.Cmd) > 0 && !strings.EqualFold(r.Cmd, message.Cmd) {
+		return false
+	}
+	if r.Ack != nil && *r.Ack != message.Ack {
+		return false
+	}
+	if r.Failed != nil && *r.Failed != (message.Result != 0) {
+		return false
+	}
+	return true
+}
+
+//set title and body keys by the first matched rule, scheme and cmd if none matches
+func deriveMessage(rules []DeriveRule, message *IntercomMessage) {
+	message.Title = message.Scheme
+	message.Body = message.Cmd
+	for _, v := range rules {
+		if !v.match(message) {
+			continue
+		}
+		if len(v.Title) > 0 {
+			message.Title = v.Title
+		}
+		if len(v.Body) > 0 {
+			message.Body = v.Body
+		}
+		return
+	}
+}
@@ -0,0 +1,36 @@
+package push
+
+import "testing"
+
+//title and body legacy MakePostData produced for raw intercom fields
+func TestDeriveLegacyMakePostData(t *testing.T) {
+	cases := []struct {
+		name   string
+		scheme string
+		cmd    string
+		ack    bool
+		result int
+		title  string
+		body   string
+	}{
+		{"incoming call", "icom", "call", false, 0, "icom", "indoorcall"},
+		{"incoming call ignores result", "icom", "call", false, 1, "icom", "indoorcall"},
+		{"call out failed", "icom", "call", true, 1, "icom", "callout_failed"},
+		{"call out failed negative result", "icom", "call", true, -1, "icom", "callout_failed"},
+		{"call out success", "icom", "call", true, 0, "icom", "callout_success"},
+		{"case insensitive call", "ICOM", "Call", false, 0, "ICOM", "indoorcall"},
+		{"security switch", "security", "switch", false, 0, "security", "security_switch"},
+		{"switch of any scheme", "icom", "SWITCH", true, 1, "icom", "security_switch"},
+		{"call of other scheme", "alarm", "call", false, 0, "alarm", "call"},
+		{"other cmd", "icom", "hangup", true, 0, "icom", "hangup"},
+	}
+	for _, v := range cases {
+		t.Run(v.name, func(t *testing.T) {
+			message := &IntercomMessage{Scheme: v.scheme, Cmd: v.cmd, Ack: v.ack, Result: v.result}
+			deriveMessage(defaultDeriveRules, message)
+			if message.Title != v.title || message.Body != v.body {
+				t.Errorf("title %q body %q, want %q %q", message.Title, message.Body, v.title, v.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package push
+
+import (
+	"jingxi.cn/transitservice/conf"
+)
+
+//server a configured provider sends to, vendor default when url is empty
+type Endpoint struct {
+	Provider string
+	Url      string
+}
+
+func vendorUrl(url string, defaultUrl string) string {
+	if len(url) < 1 {
+		return defaultUrl
+	}
+	return url
+}
+
+//endpoints of the providers NewPushService would create
+func Endpoints(c *conf.ServerConfig) []Endpoint {
+	endpoints := make([]Endpoint, 0)
+	if c.IsSupportYunxin() {
+		endpoints = append(endpoints, Endpoint{ProviderYunxin, c.Push.SendAttachMsgUrl})
+	}
+	if c.IsSupportApns() {
+		endpoints = append(endpoints, Endpoint{ProviderApns, vendorUrl(c.Apns.Url, apnsProductionUrl)})
+	}
+	if c.IsSupportFcm() {
+		endpoints = append(endpoints, Endpoint{ProviderFcm, vendorUrl(c.Fcm.Url, fcmProductionUrl)})
+	}
+	if c.IsSupportHuawei() {
+		endpoints = append(endpoints, Endpoint{ProviderHuawei, vendorUrl(c.Huawei.Url, huaweiPushUrl)})
+	}
+	if c.IsSupportXiaomi() {
+		endpoints = append(endpoints, Endpoint{ProviderXiaomi, vendorUrl(c.Xiaomi.Url, xiaomiPushUrl)})
+	}
+	if c.IsSupportOppo() {
+		endpoints = append(endpoints, Endpoint{ProviderOppo, vendorUrl(c.Oppo.Url, oppoPushUrl)})
+	}
+	if c.IsSupportVivo() {
+		endpoints = append(endpoints, Endpoint{ProviderVivo, vendorUrl(c.Vivo.Url, vivoPushUrl)})
+	}
+	return endpoints
+}
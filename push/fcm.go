@@ -0,0 +1,270 @@
+package push
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"jingxi.cn/transitservice/conf"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//https://firebase.google.com/docs/cloud-messaging/send-message#rest
+
+const (
+	ProviderFcm = "fcm"
+
+	fcmProductionUrl = "https://fcm.googleapis.com"
+	fcmScope         = "https://www.googleapis.com/auth/firebase.messaging"
+	fcmTokenLifetime = time.Hour
+)
+
+//google service account json key
+type ServiceAccount struct {
+	Type         string `json:"type"`
+	ProjectId    string `json:"project_id"`
+	PrivateKeyId string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenUri     string `json:"token_uri"`
+}
+
+type FcmNotification struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type FcmAndroidNotification struct {
+	ChannelId string `json:"channel_id,omitempty"`
+	Sound     string `json:"sound,omitempty"`
+}
+
+type FcmAndroidConfig struct {
+	Priority     string                  `json:"priority,omitempty"`
+	Ttl          string                  `json:"ttl,omitempty"` //seconds with suffix s, e.g. "30s"
+	Notification *FcmAndroidNotification `json:"notification,omitempty"`
+}
+
+type FcmMessage struct {
+	Token        string            `json:"token"`
+	Data         map[string]string `json:"data"`
+	Notification *FcmNotification  `json:"notification,omitempty"`
+	Android      *FcmAndroidConfig `json:"android,omitempty"`
+}
+
+type fcmRequest struct {
+	Message FcmMessage `json:"message"`
+}
+
+type fcmError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+		Details []struct {
+			Type      string `json:"@type"`
+			ErrorCode string `json:"errorCode"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+//https://firebase.google.com/docs/reference/fcm/rest/v1/ErrorCode
+var fcmRetryableErrors = map[string]bool{
+	"UNAVAILABLE":    true,
+	"INTERNAL":       true,
+	"QUOTA_EXCEEDED": true,
+}
+
+type FcmProvider struct {
+	conf    conf.Fcm
+	account ServiceAccount
+	key     crypto.Signer
+	client  *http.Client
+	token   tokenCache //oauth2 access token
+}
+
+func NewFcmProvider(c conf.Fcm, keyData []byte) (*FcmProvider, error) {
+	var account ServiceAccount
+	err := json.Unmarshal(keyData, &account)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Url) < 1 {
+		c.Url = fcmProductionUrl
+	}
+	if len(c.ProjectId) < 1 {
+		c.ProjectId = account.ProjectId
+	}
+	if len(c.TokenUrl) < 1 {
+		c.TokenUrl = account.TokenUri
+	}
+	if len(c.ProjectId) < 1 || len(c.TokenUrl) < 1 {
+		return nil, errors.New("fcm project id or token url empty")
+	}
+	return &FcmProvider{
+		conf:    c,
+		account: account,
+		key:     key,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}, nil
+}
+
+func (p *FcmProvider) Name() string {
+	return ProviderFcm
+}
+
+//https://developers.google.com/identity/protocols/oauth2/service-account#httprest
+func (p *FcmProvider) accessToken() (string, error) {
+	return p.token.get(func() (string, time.Duration, error) {
+		now := time.Now()
+		assertion, err := createJwt(p.account.PrivateKeyId, map[string]interface{}{
+			"iss":   p.account.ClientEmail,
+			"scope": fcmScope,
+			"aud":   p.conf.TokenUrl,
+			"iat":   now.Unix(),
+			"exp":   now.Add(fcmTokenLifetime).Unix(),
+		}, p.key)
+		if err != nil {
+			return "", 0, err
+		}
+		params := url.Values{}
+		params.Add("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		params.Add("assertion", assertion)
+		resp, err := p.client.PostForm(p.conf.TokenUrl, params)
+		if err != nil {
+			return "", 0, err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return "", 0, err
+		}
+		var r struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int    `json:"expires_in"`
+		}
+		if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &r) != nil || len(r.AccessToken) < 1 {
+			return "", 0, fmt.Errorf("fcm oauth2 token error(%d): %s", resp.StatusCode, string(body))
+		}
+		return r.AccessToken, time.Duration(r.ExpiresIn) * time.Second, nil
+	})
+}
+
+//fcm data values must be strings
+func createFcmData(message *IntercomMessage) map[string]string {
+	return map[string]string{
+		"device":   message.Device,
+		"platform": strconv.Itoa(message.Platform),
+		"cid":      message.Cid,
+		"fid":      message.Fid,
+		"scheme":   message.Scheme,
+		"cmd":      message.Cmd,
+		"time":     strconv.FormatFloat(message.CreateTime, 'f', -1, 64),
+		"title":    message.Title,
+		"body":     message.Body,
+		"ack":      strconv.FormatBool(message.Ack),
+		"result":   strconv.Itoa(message.Result),
+		"message":  message.Message,
+	}
+}
+
+func (p *FcmProvider) createMessage(message *IntercomMessage) FcmMessage {
+	m := FcmMessage{
+		Token: message.Device,
+		Data:  createFcmData(message),
+		Notification: &FcmNotification{
+			Title: message.Title,
+			Body:  message.Body,
+		},
+		Android: &FcmAndroidConfig{Priority: "HIGH"},
+	}
+	if message.Ttl > 0 {
+		m.Android.Ttl = strconv.Itoa(message.Ttl) + "s"
+	}
+	if channel := matchChannel(p.conf.Channels, message); channel != nil {
+		if len(channel.Priority) > 0 {
+			m.Android.Priority = strings.ToUpper(channel.Priority)
+		}
+		if len(channel.ChannelId) > 0 {
+			m.Android.Notification = &FcmAndroidNotification{ChannelId: channel.ChannelId}
+		}
+	}
+	if len(message.Sound) > 0 && !message.Silent {
+		if m.Android.Notification == nil {
+			m.Android.Notification = &FcmAndroidNotification{}
+		}
+		m.Android.Notification.Sound = message.Sound
+	}
+	return m
+}
+
+func (p *FcmProvider) Push(message *IntercomMessage) (*DeliveryResult, error) {
+	data, err := json.Marshal(fcmRequest{Message: p.createMessage(message)})
+	if err != nil {
+		return nil, err
+	}
+	token, err := p.accessToken()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST",
+		fmt.Sprintf("%s/v1/projects/%s/messages:send", p.conf.Url, p.conf.ProjectId),
+		bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return p.parseResult(resp.StatusCode, body), nil
+}
+
+func (p *FcmProvider) parseResult(status int, body []byte) *DeliveryResult {
+	result := &DeliveryResult{
+		Provider: ProviderFcm,
+		Success:  status == http.StatusOK,
+		Code:     status,
+		Raw:      string(body),
+	}
+	if result.Success {
+		return result
+	}
+	var e fcmError
+	_ = json.Unmarshal(body, &e)
+	reason := e.Error.Status
+	for _, v := range e.Error.Details {
+		if len(v.ErrorCode) > 0 {
+			reason = v.ErrorCode
+		}
+	}
+	result.Reason = reason
+	result.InvalidToken = reason == "UNREGISTERED"
+	if status == http.StatusUnauthorized {
+		p.token.reset()
+		result.Retryable = true
+	} else {
+		result.Retryable = fcmRetryableErrors[reason] || status >= http.StatusInternalServerError
+	}
+	return result
+}
@@ -0,0 +1,98 @@
+package push
+
+import (
+	"encoding/json"
+	"jingxi.cn/transitservice/conf"
+	"net/http"
+	"testing"
+)
+
+const (
+	fcmTestSend  = "/v1/projects/project-1/messages:send"
+	fcmTestToken = "/token"
+)
+
+var fcmTestAuth = map[string]fakeReply{
+	fcmTestToken: {status: http.StatusOK, body: `{"access_token":"access-1","expires_in":3600}`},
+}
+
+func newTestFcmProvider(t *testing.T, serverUrl string) *FcmProvider {
+	keyData, err := json.Marshal(ServiceAccount{
+		Type:         "service_account",
+		ProjectId:    "project-1",
+		PrivateKeyId: "key-id",
+		PrivateKey:   string(newTestRsaKey(t)),
+		ClientEmail:  "push@project-1.iam.gserviceaccount.com",
+		TokenUri:     serverUrl + fcmTestToken,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewFcmProvider(conf.Fcm{
+		Url: serverUrl,
+		Channels: []conf.PushChannel{
+			{Scheme: "call", ChannelId: "calls", Priority: "high"},
+		},
+	}, keyData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestFcmPush(t *testing.T) {
+	runResultCases(t, ProviderFcm, fcmTestSend, fcmTestAuth, []resultCase{
+		{"success", fakeReply{status: http.StatusOK, body: `{"name":"projects/project-1/messages/1"}`},
+			wantResult{success: true}},
+		{"unregistered", fakeReply{status: http.StatusNotFound, body: `{"error":{"code":404,"status":"NOT_FOUND",
+			"details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"UNREGISTERED"}]}}`},
+			wantResult{invalidToken: true}},
+		{"unavailable", fakeReply{status: http.StatusServiceUnavailable, body: `{"error":{"code":503,"status":"UNAVAILABLE"}}`},
+			wantResult{retryable: true}},
+		{"invalid argument", fakeReply{status: http.StatusBadRequest, body: `{"error":{"code":400,"status":"INVALID_ARGUMENT"}}`},
+			wantResult{}},
+		{"unparsable body", fakeReply{status: http.StatusBadRequest, body: `<html>bad request</html>`},
+			wantResult{}},
+		{"unparsable server error", fakeReply{status: http.StatusBadGateway, body: `<html>bad gateway</html>`},
+			wantResult{retryable: true}},
+	}, func(serverUrl string) PushProvider {
+		return newTestFcmProvider(t, serverUrl)
+	})
+}
+
+func TestFcmRequest(t *testing.T) {
+	f := newFakePush(t, map[string]fakeReply{
+		fcmTestToken: fcmTestAuth[fcmTestToken],
+		fcmTestSend:  {status: http.StatusOK, body: `{"name":"projects/project-1/messages/1"}`},
+	})
+	p := newTestFcmProvider(t, f.URL)
+	for i := 0; i < 2; i++ {
+		if result, err := p.Push(newTestMessage()); err != nil || !result.Success {
+			t.Fatalf("Push: %+v %v", result, err)
+		}
+	}
+	if n := len(f.received(fcmTestToken)); n != 1 {
+		t.Errorf("%d token requests, want 1 cached", n)
+	}
+	request := f.received(fcmTestSend)[0]
+	if request.Header.Get("Authorization") != "Bearer access-1" {
+		t.Errorf("authorization %s", request.Header.Get("Authorization"))
+	}
+	var r fcmRequest
+	if err := json.Unmarshal([]byte(request.Body), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Message.Token != "token-1" || r.Message.Android.Priority != "HIGH" ||
+		r.Message.Android.Notification.ChannelId != "calls" || r.Message.Data["cid"] != "cid-1" {
+		t.Errorf("message %+v", r.Message)
+	}
+}
+
+func TestFcmTokenError(t *testing.T) {
+	f := newFakePush(t, map[string]fakeReply{
+		fcmTestToken: {status: http.StatusBadRequest, body: `{"error":"invalid_grant"}`},
+	})
+	if _, err := newTestFcmProvider(t, f.URL).Push(newTestMessage()); err == nil {
+		t.Fatal("Push without access token succeeded, want error")
+	}
+}
@@ -0,0 +1,179 @@
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"jingxi.cn/transitservice/conf"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//https://developer.huawei.com/consumer/en/doc/development/HMSCore-References/https-send-api-0000001050986197
+
+const (
+	ProviderHuawei = "huawei"
+
+	huaweiPushUrl = "https://push-api.cloud.huawei.com"
+	huaweiAuthUrl = "https://oauth-login.cloud.huawei.com/oauth2/v3/token"
+
+	huaweiSuccess      = "80000000"
+	huaweiInvalidToken = "80300007" //all tokens are invalid
+	huaweiTokenExpired = "80200003" //oauth token expired
+	huaweiAuthFailed   = "80200001"
+
+	//NORMAL is shown as service and communication message, LOW as marketing one without sound
+	huaweiImportanceNormal = "NORMAL"
+	huaweiImportanceLow    = "LOW"
+)
+
+type HuaweiClickAction struct {
+	Type int `json:"type"` //3: open app
+}
+
+type HuaweiAndroidNotification struct {
+	Title       string            `json:"title"`
+	Body        string            `json:"body"`
+	ChannelId   string            `json:"channel_id,omitempty"`
+	Importance  string            `json:"importance,omitempty"` //LOW or NORMAL
+	ClickAction HuaweiClickAction `json:"click_action"`
+}
+
+type HuaweiAndroidConfig struct {
+	Category     string                    `json:"category,omitempty"` //VOIP, IM ... message classification
+	Urgency      string                    `json:"urgency,omitempty"`  //HIGH or NORMAL
+	Ttl          string                    `json:"ttl,omitempty"`      //seconds with suffix s, e.g. "30s"
+	Notification HuaweiAndroidNotification `json:"notification"`
+}
+
+type HuaweiMessage struct {
+	Data    string              `json:"data,omitempty"`
+	Android HuaweiAndroidConfig `json:"android"`
+	Token   []string            `json:"token"`
+}
+
+type huaweiRequest struct {
+	ValidateOnly bool          `json:"validate_only"`
+	Message      HuaweiMessage `json:"message"`
+}
+
+type huaweiResponse struct {
+	Code      string `json:"code"`
+	Msg       string `json:"msg"`
+	RequestId string `json:"requestId"`
+}
+
+type HuaweiProvider struct {
+	conf   conf.VendorPush
+	client *http.Client
+	token  tokenCache //oauth2 client credentials token
+}
+
+func NewHuaweiProvider(c conf.VendorPush) *HuaweiProvider {
+	if len(c.Url) < 1 {
+		c.Url = huaweiPushUrl
+	}
+	if len(c.AuthUrl) < 1 {
+		c.AuthUrl = huaweiAuthUrl
+	}
+	return &HuaweiProvider{
+		conf:   c,
+		client: newVendorClient(),
+	}
+}
+
+func (p *HuaweiProvider) Name() string {
+	return ProviderHuawei
+}
+
+func (p *HuaweiProvider) accessToken() (string, error) {
+	return p.token.get(func() (string, time.Duration, error) {
+		params := url.Values{}
+		params.Add("grant_type", "client_credentials")
+		params.Add("client_id", p.conf.AppId)
+		params.Add("client_secret", p.conf.AppSecret)
+		status, body, err := postForm(p.client, p.conf.AuthUrl, nil, params)
+		if err != nil {
+			return "", 0, err
+		}
+		var r struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int    `json:"expires_in"`
+		}
+		if status != http.StatusOK || json.Unmarshal(body, &r) != nil || len(r.AccessToken) < 1 {
+			return "", 0, fmt.Errorf("huawei oauth2 token error(%d): %s", status, string(body))
+		}
+		return r.AccessToken, time.Duration(r.ExpiresIn) * time.Second, nil
+	})
+}
+
+func (p *HuaweiProvider) createRequest(message *IntercomMessage) huaweiRequest {
+	m := HuaweiMessage{
+		Data: createIntercomContent(message),
+		Android: HuaweiAndroidConfig{
+			Urgency: "HIGH",
+			Notification: HuaweiAndroidNotification{
+				Title:       message.Title,
+				Body:        message.Body,
+				ClickAction: HuaweiClickAction{Type: 3},
+			},
+		},
+		Token: []string{message.Device},
+	}
+	if message.Ttl > 0 {
+		m.Android.Ttl = strconv.Itoa(message.Ttl) + "s"
+	}
+	if channel := matchChannel(p.conf.Channels, message); channel != nil {
+		m.Android.Category = strings.ToUpper(channel.Category)
+		m.Android.Notification.ChannelId = channel.ChannelId
+		//classified VOIP or IM message needs normal importance, otherwise huawei may fold it as marketing
+		if len(channel.Category) > 0 {
+			m.Android.Notification.Importance = huaweiImportanceNormal
+		}
+		if len(channel.Priority) > 0 {
+			m.Android.Urgency = strings.ToUpper(channel.Priority)
+		}
+	}
+	//do-not-disturb, channel of calls rings so it is not used
+	if message.Silent {
+		m.Android.Notification.ChannelId = ""
+		m.Android.Notification.Importance = huaweiImportanceLow
+	}
+	return huaweiRequest{Message: m}
+}
+
+func (p *HuaweiProvider) Push(message *IntercomMessage) (*DeliveryResult, error) {
+	token, err := p.accessToken()
+	if err != nil {
+		return nil, err
+	}
+	status, body, err := postJson(p.client,
+		fmt.Sprintf("%s/v1/%s/messages:send", p.conf.Url, p.conf.AppId),
+		map[string]string{"Authorization": "Bearer " + token},
+		p.createRequest(message))
+	if err != nil {
+		return nil, err
+	}
+	var r huaweiResponse
+	if err = json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("invalid huawei response(%d): %s", status, string(body))
+	}
+	code, _ := strconv.Atoi(r.Code)
+	result := &DeliveryResult{
+		Provider:     ProviderHuawei,
+		Success:      r.Code == huaweiSuccess,
+		Code:         code,
+		Reason:       r.Msg,
+		InvalidToken: r.Code == huaweiInvalidToken,
+		Raw:          string(body),
+	}
+	if r.Code == huaweiTokenExpired || r.Code == huaweiAuthFailed {
+		p.token.reset()
+		result.Retryable = true
+	} else if !result.Success {
+		result.Retryable = status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+	}
+	return result, nil
+}
@@ -0,0 +1,77 @@
+package push
+
+import (
+	"encoding/json"
+	"jingxi.cn/transitservice/conf"
+	"net/http"
+	"testing"
+)
+
+const (
+	huaweiTestSend = "/v1/app-1/messages:send"
+	huaweiTestAuth = "/oauth2/v3/token"
+)
+
+var huaweiTestAuthReply = map[string]fakeReply{
+	huaweiTestAuth: {status: http.StatusOK, body: `{"access_token":"access-1","expires_in":3600}`},
+}
+
+func newTestHuaweiProvider(serverUrl string) *HuaweiProvider {
+	return NewHuaweiProvider(conf.VendorPush{
+		Url:       serverUrl,
+		AuthUrl:   serverUrl + huaweiTestAuth,
+		AppId:     "app-1",
+		AppSecret: "secret",
+		Channels: []conf.PushChannel{
+			{Scheme: "call", ChannelId: "calls", Category: "voip"},
+		},
+	})
+}
+
+func TestHuaweiPush(t *testing.T) {
+	runResultCases(t, ProviderHuawei, huaweiTestSend, huaweiTestAuthReply, []resultCase{
+		{"success", fakeReply{status: http.StatusOK, body: `{"code":"80000000","msg":"Success","requestId":"1"}`},
+			wantResult{success: true}},
+		{"invalid token", fakeReply{status: http.StatusBadRequest, body: `{"code":"80300007","msg":"All the tokens are invalid"}`},
+			wantResult{invalidToken: true}},
+		{"internal error", fakeReply{status: http.StatusInternalServerError, body: `{"code":"81000001","msg":"System inner error"}`},
+			wantResult{retryable: true}},
+		{"oauth token expired", fakeReply{status: http.StatusUnauthorized, body: `{"code":"80200003","msg":"OAuth token expired"}`},
+			wantResult{retryable: true}},
+		{"unparsable body", fakeReply{status: http.StatusBadGateway, body: `<html>bad gateway</html>`},
+			wantResult{err: true}},
+	}, func(serverUrl string) PushProvider {
+		return newTestHuaweiProvider(serverUrl)
+	})
+}
+
+func TestHuaweiRequest(t *testing.T) {
+	f := newFakePush(t, map[string]fakeReply{
+		huaweiTestAuth: huaweiTestAuthReply[huaweiTestAuth],
+		huaweiTestSend: {status: http.StatusOK, body: `{"code":"80000000"}`},
+	})
+	if _, err := newTestHuaweiProvider(f.URL).Push(newTestMessage()); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	request := f.received(huaweiTestSend)[0]
+	if request.Header.Get("Authorization") != "Bearer access-1" {
+		t.Errorf("authorization %s", request.Header.Get("Authorization"))
+	}
+	var r huaweiRequest
+	if err := json.Unmarshal([]byte(request.Body), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Message.Token[0] != "token-1" || r.Message.Android.Category != "VOIP" ||
+		r.Message.Android.Notification.ChannelId != "calls" || r.Message.Android.Notification.Importance != "NORMAL" {
+		t.Errorf("message %+v", r.Message)
+	}
+}
+
+func TestHuaweiSilent(t *testing.T) {
+	message := newTestMessage()
+	message.Silent = true
+	n := newTestHuaweiProvider("").createRequest(message).Message.Android.Notification
+	if n.Importance != "LOW" || len(n.ChannelId) > 0 {
+		t.Errorf("notification %+v, want low importance without channel", n)
+	}
+}
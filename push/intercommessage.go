@@ -1,64 +1,6 @@
 package push
 
-/*
-
-void MakePostData(const User &user,
-                  const protocol::ProbufMessage *message,
-                  std::string *output) {
-  base::DictionaryValue root;
-  root.SetString("device", user.push_id);
-  root.SetInteger("platform", user.platform);
-  root.SetString("cid", user.cid);
-  root.SetString("fid", user.fid);
-  root.SetString("scheme", message->scheme());
-  root.SetString("cmd", message->cmd());
-  root.SetDouble("time", base::Time::Now().ToJsTime());
-
-  bool ack = false;
-  int result = 0;
-  {
-    scoped_ptr<base::Value> value(base::JSONReader::Read(message->payload()));
-    if (value) {
-      const base::DictionaryValue *tmp = nullptr;
-      if (value->GetAsDictionary(&tmp) && tmp) {
-        tmp->GetBoolean("ack", &ack);
-        tmp->GetInteger("result", &result);
-      }
-    }
-  }
-  std::string body = message->cmd();
-
-  if (base::CompareCaseInsensitiveASCII(message->scheme(), "icom") == 0
-      && base::CompareCaseInsensitiveASCII(message->cmd(), "call") == 0) {
-    if (!ack) {
-      body = "indoorcall";
-    } else {
-      if (result) {
-        body = "callout_failed";
-      } else {
-        body = "callout_success";
-      }
-    }
-  }
-
-  if (base::CompareCaseInsensitiveASCII(body, "switch") == 0) {
-    body = "security_switch";
-  }
-
-  root.SetString("title", message->scheme());
-  root.SetString("body", body);
-  root.SetBoolean("ack", ack);
-  root.SetInteger("result", result);
-
-  std::string str;
-  message->SerializeToString(&str);
-  base::Base64Encode(str, &str);
-  root.SetString("message", str);
-
-  base::JSONWriter::Write(root, output);
-}
-*/
-
+//fields posted to /push, title and body are derived as legacy MakePostData when both are empty
 type IntercomMessage struct {
 	Device     string  `json:"device"` // device accid which push to
 	Platform   int     `json:"platform"`
@@ -71,5 +13,17 @@ type IntercomMessage struct {
 	Body       string  `json:"body"`
 	Ack        bool    `json:"ack"`
 	Result     int     `json:"result"`
-	Message    string  `json:"message"` //base64 actually intercom message
+	Message    string  `json:"message"`            //base64 actually intercom message
+	User       string  `json:"user,omitempty"`     //resident user, resolved to push tokens when Device is empty
+	Provider   string  `json:"provider,omitempty"` //push provider: yunxin, apns, fcm, huawei, xiaomi, oppo, vivo; empty is default
+	Sound      string  `json:"sound,omitempty"`    //notification sound set by keyword rule, empty is default
+	Category   string  `json:"category,omitempty"` //notification category set by keyword rule
+	Locale     string  `json:"locale,omitempty"`   //language of notification text, empty is locale of recipient token
+	Ttl        int     `json:"-"`                  //seconds left to live, passed as provider expiration; 0 is provider default
+	Silent     bool    `json:"-"`                  //do-not-disturb, sent without sound
+}
+
+//message is resolved to tokens of User, or of all residents of family Fid when User is empty
+func (m *IntercomMessage) IsFanOut() bool {
+	return len(m.Device) < 1 && (len(m.User) > 0 || len(m.Fid) > 0)
 }
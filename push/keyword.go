@@ -3,6 +3,7 @@ package push
 import (
 	"encoding/json"
 	"io/ioutil"
+	"jingxi.cn/transitservice/registry"
 	"strings"
 )
 
@@ -12,47 +13,113 @@ type Pair struct {
 }
 
 type Keyword struct {
-	DefaultTitle string `json:"defaultTitle"`
-	DefaultBody  string `json:"defaultBody"`
-	Titles       []Pair `json:"title"`
-	Bodys        []Pair `json:"body"`
-	titleMap     map[string]string
-	bodyMap      map[string]string
+	DefaultTitle string        `json:"defaultTitle"`
+	DefaultBody  string        `json:"defaultBody"`
+	Titles       []Pair        `json:"title"`
+	Bodys        []Pair        `json:"body"`
+	Derives      []DeriveRule  `json:"derive"` //title and body of message without them, empty is legacy rules
+	Rules        []KeywordRule `json:"rules"`  //override text of title and body maps
+	titleMap     map[string]*Template
+	bodyMap      map[string]*Template
+	defaultTitle *Template
+	defaultBody  *Template
 }
 
+//values of title and body may contain placeholders, see templateNames
 func LoadKeyword(file string) (*Keyword, error) {
 	data, err := ioutil.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
+	return ParseKeyword(data)
+}
+
+//parse and compile content of keyword file
+func ParseKeyword(data []byte) (*Keyword, error) {
 	var c Keyword
-	err = json.Unmarshal(data, &c)
+	err := json.Unmarshal(data, &c)
 	if err != nil {
 		return nil, err
 	}
-	c.titleMap = make(map[string]string)
-	c.bodyMap = make(map[string]string)
-	for _, v := range c.Titles {
-		c.titleMap[strings.ToLower(v.Name)] = v.Value
+	if err = compileRules(c.Rules); err != nil {
+		return nil, err
+	}
+	if len(c.Derives) < 1 {
+		c.Derives = defaultDeriveRules
+	}
+	if c.defaultTitle, err = compileTemplate(c.DefaultTitle); err != nil {
+		return nil, err
+	}
+	if c.defaultBody, err = compileTemplate(c.DefaultBody); err != nil {
+		return nil, err
+	}
+	if c.titleMap, err = compilePairs(c.Titles); err != nil {
+		return nil, err
 	}
-	for _, v := range c.Bodys {
-		c.bodyMap[strings.ToLower(v.Name)] = v.Value
+	if c.bodyMap, err = compilePairs(c.Bodys); err != nil {
+		return nil, err
 	}
 	return &c, nil
 }
 
-func (c *Keyword) Replace(message *IntercomMessage) {
+func compilePairs(pairs []Pair) (map[string]*Template, error) {
+	m := make(map[string]*Template)
+	for _, v := range pairs {
+		t, err := compileTemplate(v.Value)
+		if err != nil {
+			return nil, err
+		}
+		m[strings.ToLower(v.Name)] = t
+	}
+	return m, nil
+}
+
+//the first rule matched message by priority, nil if none matches
+func (c *Keyword) Match(message *IntercomMessage) *KeywordRule {
+	for k := range c.Rules {
+		if c.Rules[k].match(message) {
+			return &c.Rules[k]
+		}
+	}
+	return nil
+}
+
+//replace title and body keys with text, returns the matched rule
+//device is the registry entry of message cid which fills placeholders, may be nil
+func (c *Keyword) Replace(message *IntercomMessage, device *registry.Device) *KeywordRule {
+	if len(message.Title) < 1 && len(message.Body) < 1 {
+		deriveMessage(c.Derives, message)
+	}
+	rule := c.Match(message)
+	vars := templateVars(message, device)
+
 	lowTitle := strings.ToLower(message.Title)
 	lowBody := strings.ToLower(message.Body)
 
 	if v, ok := c.titleMap[lowTitle]; ok {
-		message.Title = v
+		message.Title = v.Execute(vars)
 	} else {
-		message.Title = c.DefaultTitle
+		message.Title = c.defaultTitle.Execute(vars)
 	}
 	if v, ok := c.bodyMap[lowBody]; ok {
-		message.Body = v
+		message.Body = v.Execute(vars)
 	} else {
-		message.Body = c.DefaultBody
+		message.Body = c.defaultBody.Execute(vars)
+	}
+	if rule == nil {
+		return nil
+	}
+	if len(rule.Title) > 0 {
+		message.Title = rule.title.Execute(vars)
+	}
+	if len(rule.Body) > 0 {
+		message.Body = rule.body.Execute(vars)
+	}
+	if len(rule.Sound) > 0 {
+		message.Sound = rule.Sound
+	}
+	if len(rule.Category) > 0 {
+		message.Category = rule.Category
 	}
+	return rule
 }
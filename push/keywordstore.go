@@ -0,0 +1,315 @@
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"jingxi.cn/transitservice/conf"
+	"jingxi.cn/transitservice/utils"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}([-_][A-Za-z0-9]{1,8})*$`)
+
+var ErrInvalidLocale = errors.New("invalid locale")
+
+//keyword file of a locale and its latest revision
+type KeywordFile struct {
+	Locale   string          `json:"locale"` //empty is message.json
+	File     string          `json:"file"`
+	Revision *utils.Revision `json:"revision"` //nil if never saved by admin api
+}
+
+//keyword files edited by admin api, every save is kept as a revision in <dir>/<keyword file>/
+//latest revisions are written to keyword files of conf directory, instances sharing dir pick them up by Sync
+//Sync runs only at startup and on /reload, other instances keep old keywords until then
+type KeywordStore struct {
+	dir     string
+	confDir string
+	locale  conf.Locale
+	mu      sync.Mutex
+}
+
+func NewKeywordStore(dir string, confDir string, locale conf.Locale) *KeywordStore {
+	return &KeywordStore{
+		dir:     dir,
+		confDir: confDir,
+		locale:  locale,
+	}
+}
+
+//locale fallback used when keywords are loaded after save, e.g. after configuration reload
+func (s *KeywordStore) SetLocale(locale conf.Locale) {
+	s.mu.Lock()
+	s.locale = locale
+	s.mu.Unlock()
+}
+
+//keyword file of locale in conf directory, an existing file of other letter case is reused
+func (s *KeywordStore) file(locale string) (string, error) {
+	if len(locale) < 1 {
+		return filepath.Join(s.confDir, keywordFile), nil
+	}
+	if !localePattern.MatchString(locale) {
+		return "", fmt.Errorf("%w %s", ErrInvalidLocale, locale)
+	}
+	files, err := filepath.Glob(filepath.Join(s.confDir, "message.*.json"))
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		if strings.EqualFold(localeOf(file), locale) {
+			return file, nil
+		}
+	}
+	return filepath.Join(s.confDir, "message."+locale+".json"), nil
+}
+
+func (s *KeywordStore) revisions(locale string) *utils.RevisionStore {
+	name := strings.TrimSuffix(keywordFile, ".json")
+	if len(locale) > 0 {
+		name += "." + strings.ToLower(locale)
+	}
+	return utils.NewRevisionStore(filepath.Join(s.dir, name))
+}
+
+//content is a valid keyword file
+func (s *KeywordStore) Validate(content []byte) error {
+	_, err := ParseKeyword(content)
+	return err
+}
+
+//keyword files of conf directory, message.json first
+func (s *KeywordStore) List() ([]*KeywordFile, error) {
+	files, err := filepath.Glob(filepath.Join(s.confDir, "message.*.json"))
+	if err != nil {
+		return nil, err
+	}
+	locales := []string{""}
+	for _, file := range files {
+		locales = append(locales, localeOf(file))
+	}
+	list := make([]*KeywordFile, 0, len(locales))
+	for _, locale := range locales {
+		file, err := s.file(locale)
+		if err != nil {
+			continue
+		}
+		revision, err := s.revisions(locale).Latest()
+		if err != nil {
+			return nil, err
+		}
+		if revision != nil {
+			revision.Content = nil
+		}
+		list = append(list, &KeywordFile{
+			Locale:   locale,
+			File:     filepath.Base(file),
+			Revision: revision,
+		})
+	}
+	return list, nil
+}
+
+//content of keyword file of locale, os.ErrNotExist if the file does not exist
+func (s *KeywordStore) Current(locale string) ([]byte, error) {
+	file, err := s.file(locale)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(file)
+}
+
+//oldest first, without content
+func (s *KeywordStore) Revisions(locale string) ([]*utils.Revision, error) {
+	if _, err := s.file(locale); err != nil {
+		return nil, err
+	}
+	return s.revisions(locale).List()
+}
+
+//utils.ErrRevisionNotFound if not found
+func (s *KeywordStore) Revision(locale string, id int) (*utils.Revision, error) {
+	if _, err := s.file(locale); err != nil {
+		return nil, err
+	}
+	revision, err := s.revisions(locale).Get(id)
+	if err == nil && revision == nil {
+		err = utils.ErrRevisionNotFound
+	}
+	return revision, err
+}
+
+//unified diff between revisions, to 0 is the current keyword file
+func (s *KeywordStore) Diff(locale string, from int, to int) (string, error) {
+	revision, err := s.Revision(locale, from)
+	if err != nil {
+		return "", err
+	}
+	fromName := fmt.Sprintf("revision %d", from)
+	fromContent := indentJson(revision.Content)
+	toName := "current"
+	var toContent []byte
+	if to > 0 {
+		if revision, err = s.Revision(locale, to); err != nil {
+			return "", err
+		}
+		toName = fmt.Sprintf("revision %d", to)
+		toContent = indentJson(revision.Content)
+	} else {
+		if toContent, err = s.Current(locale); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		toContent = indentJson(toContent)
+	}
+	return utils.Diff(fromName, toName, string(fromContent), string(toContent)), nil
+}
+
+//write content to keyword file of locale and keep it as a revision
+//returns keywords of every locale loaded after the write, the keyword file is restored if they fail to load
+func (s *KeywordStore) Save(locale string, content []byte, author string, comment string) (*utils.Revision, *Keywords, error) {
+	if err := s.Validate(content); err != nil {
+		return nil, nil, err
+	}
+	file, err := s.file(locale)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	revisions := s.revisions(locale)
+	old, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	//text edited before admin api is the first revision, so it can be rolled back to
+	latest, err := revisions.Latest()
+	if err != nil {
+		return nil, nil, err
+	}
+	if latest == nil && old != nil {
+		if _, err = revisions.Add(utils.FileAuthor, "before admin api", old); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err = writeFile(file, indentJson(content)); err != nil {
+		return nil, nil, err
+	}
+	keywords, err := LoadKeywords(s.confDir, s.locale)
+	if err == nil {
+		var revision *utils.Revision
+		if revision, err = revisions.Add(author, comment, content); err == nil {
+			revision.Content = nil
+			logrus.Infof("keyword file %s saved as revision %d by %s", file, revision.Id, author)
+			return revision, keywords, nil
+		}
+	}
+	if old != nil {
+		_ = writeFile(file, old)
+	} else {
+		_ = os.Remove(file)
+	}
+	return nil, nil, err
+}
+
+//save content of revision id again as the latest revision
+func (s *KeywordStore) Rollback(locale string, id int, author string) (*utils.Revision, *Keywords, error) {
+	revision, err := s.Revision(locale, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.Save(locale, revision.Content, author, fmt.Sprintf("rollback to revision %d", id))
+}
+
+//write latest revisions saved by other instances to keyword files,
+//a keyword file edited on disk after its latest revision is kept as a new revision instead
+//returns true if any keyword file is written
+func (s *KeywordStore) Sync() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dirs, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	name := strings.TrimSuffix(keywordFile, ".json")
+	changed := false
+	for _, d := range dirs {
+		if !d.IsDir() || (d.Name() != name && !strings.HasPrefix(d.Name(), name+".")) {
+			continue
+		}
+		locale := strings.TrimPrefix(strings.TrimPrefix(d.Name(), name), ".")
+		file, err := s.file(locale)
+		if err != nil {
+			continue
+		}
+		revisions := s.revisions(locale)
+		latest, err := revisions.Latest()
+		if err != nil {
+			return changed, err
+		}
+		if latest == nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return changed, err
+		}
+		if err == nil {
+			if bytes.Equal(indentJson(data), indentJson(latest.Content)) {
+				continue
+			}
+			info, err := os.Stat(file)
+			if err != nil {
+				return changed, err
+			}
+			if info.ModTime().UnixNano()/1e6 > latest.CreateTime {
+				if err = s.Validate(data); err != nil {
+					logrus.Errorf("keyword file %s edited on disk is invalid: %v", file, err)
+					continue
+				}
+				if _, err = revisions.Add(utils.FileAuthor, "edited on disk", data); err != nil {
+					return changed, err
+				}
+				logrus.Infof("keyword file %s edited on disk, kept as a revision", file)
+				continue
+			}
+		}
+		if err = writeFile(file, indentJson(latest.Content)); err != nil {
+			return changed, err
+		}
+		logrus.Infof("keyword file %s updated to revision %d", file, latest.Id)
+		changed = true
+	}
+	return changed, nil
+}
+
+//content indented by tab, unchanged if it is not json
+func indentJson(content []byte) []byte {
+	var b bytes.Buffer
+	if err := json.Indent(&b, bytes.TrimSpace(content), "", "\t"); err != nil {
+		return content
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+//write to a temporary file and rename like utils.SaveJsonFile, keeping data as it is
+func writeFile(file string, data []byte) error {
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,109 @@
+package push
+
+import (
+	"fmt"
+	"io/ioutil"
+	"jingxi.cn/transitservice/conf"
+	"jingxi.cn/transitservice/registry"
+	"jingxi.cn/transitservice/utils"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const keywordFile = "message.json"
+
+//keywords of every locale, loaded and replaced together
+type Keywords struct {
+	keywords      map[string]*Keyword //lower case locale, empty is message.json
+	fallback      map[string][]string
+	defaultLocale string
+	digest        string //of keyword files, tells whether a reload changed them
+}
+
+//message.json and every message.<locale>.json of dir
+func LoadKeywords(dir string, c conf.Locale) (*Keywords, error) {
+	k := &Keywords{
+		keywords:      make(map[string]*Keyword),
+		fallback:      make(map[string][]string),
+		defaultLocale: strings.ToLower(c.Default),
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "message.*.json"))
+	if err != nil {
+		return nil, err
+	}
+	files = append([]string{filepath.Join(dir, keywordFile)}, files...)
+	var content strings.Builder
+	for i, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		keyword, err := ParseKeyword(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Base(file), err)
+		}
+		locale := ""
+		if i > 0 {
+			locale = strings.ToLower(localeOf(file))
+		}
+		k.keywords[locale] = keyword
+		content.WriteString(filepath.Base(file))
+		content.Write(data)
+	}
+	k.digest = utils.Md5String(content.String())
+	for locale, chain := range c.Fallback {
+		k.fallback[strings.ToLower(locale)] = chain
+	}
+	return k, nil
+}
+
+//changes when any keyword file changes
+func (k *Keywords) Digest() string {
+	return k.digest
+}
+
+//locale of message.<locale>.json
+func localeOf(file string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "message."), ".json")
+}
+
+//locales tried for locale: itself, its fallback, its language, language fallback, default
+func (k *Keywords) chain(locale string) []string {
+	locale = strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+	var chain []string
+	if len(locale) > 0 {
+		chain = append(chain, locale)
+		chain = append(chain, k.fallback[locale]...)
+		if i := strings.IndexByte(locale, '-'); i > 0 {
+			chain = append(chain, locale[:i])
+			chain = append(chain, k.fallback[locale[:i]]...)
+		}
+	}
+	return append(chain, k.defaultLocale, "")
+}
+
+//keyword of the first locale in chain which has a file
+func (k *Keywords) Get(locale string) *Keyword {
+	for _, v := range k.chain(locale) {
+		if keyword, ok := k.keywords[strings.ToLower(v)]; ok {
+			return keyword
+		}
+	}
+	return k.keywords[""]
+}
+
+//locales loaded, empty is message.json
+func (k *Keywords) Locales() []string {
+	locales := make([]string, 0, len(k.keywords))
+	for v := range k.keywords {
+		locales = append(locales, v)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+//replace by keyword of message locale
+func (k *Keywords) Replace(message *IntercomMessage, device *registry.Device) *KeywordRule {
+	return k.Get(message.Locale).Replace(message, device)
+}
@@ -0,0 +1,160 @@
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"jingxi.cn/transitservice/conf"
+	"jingxi.cn/transitservice/utils"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+//https://open.oppomobile.com/new/developmentDoc/info?id=11238
+
+const (
+	ProviderOppo = "oppo"
+
+	oppoPushUrl       = "https://api.push.oppomobile.com"
+	oppoTokenLifetime = 24 * time.Hour
+
+	oppoInvalidAuthToken = 11
+	oppoInvalidRegId     = 10000
+
+	oppoNotifyBar        = 1 //notification bar only, no sound or vibration
+	oppoNotifyLockScreen = 2
+)
+
+type OppoNotification struct {
+	Title            string `json:"title"`
+	Content          string `json:"content"`
+	ChannelId        string `json:"channel_id,omitempty"`
+	Category         string `json:"category,omitempty"`     //IM, ... message classification
+	NotifyLevel      int    `json:"notify_level,omitempty"` //1: bar, 2: bar and lock screen, 16: strong reminder
+	ClickActionType  int    `json:"click_action_type"`
+	ActionParameters string `json:"action_parameters,omitempty"`
+	OffLineTtl       int    `json:"off_line_ttl,omitempty"` //seconds kept for offline device
+}
+
+type oppoMessage struct {
+	TargetType   int              `json:"target_type"` //2: registration id
+	TargetValue  string           `json:"target_value"`
+	Notification OppoNotification `json:"notification"`
+}
+
+type oppoResponse struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+type OppoProvider struct {
+	conf   conf.VendorPush
+	client *http.Client
+	token  tokenCache //auth_token, valid 24 hours
+}
+
+func NewOppoProvider(c conf.VendorPush) *OppoProvider {
+	if len(c.Url) < 1 {
+		c.Url = oppoPushUrl
+	}
+	if len(c.AuthUrl) < 1 {
+		c.AuthUrl = c.Url + "/server/v1/auth"
+	}
+	return &OppoProvider{
+		conf:   c,
+		client: newVendorClient(),
+	}
+}
+
+func (p *OppoProvider) Name() string {
+	return ProviderOppo
+}
+
+//sign: sha256(app_key + timestamp + master_secret)
+func (p *OppoProvider) authToken() (string, error) {
+	return p.token.get(func() (string, time.Duration, error) {
+		timestamp := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+		params := url.Values{}
+		params.Add("app_key", p.conf.AppKey)
+		params.Add("timestamp", timestamp)
+		params.Add("sign", utils.Sha256String(p.conf.AppKey+timestamp+p.conf.AppSecret))
+		status, body, err := postForm(p.client, p.conf.AuthUrl, nil, params)
+		if err != nil {
+			return "", 0, err
+		}
+		var r oppoResponse
+		var data struct {
+			AuthToken string `json:"auth_token"`
+		}
+		if json.Unmarshal(body, &r) != nil || r.Code != 0 || json.Unmarshal(r.Data, &data) != nil || len(data.AuthToken) < 1 {
+			return "", 0, fmt.Errorf("oppo auth token error(%d): %s", status, string(body))
+		}
+		return data.AuthToken, oppoTokenLifetime, nil
+	})
+}
+
+func (p *OppoProvider) createMessage(message *IntercomMessage) oppoMessage {
+	m := oppoMessage{
+		TargetType:  2,
+		TargetValue: message.Device,
+		Notification: OppoNotification{
+			Title:            message.Title,
+			Content:          message.Body,
+			ClickActionType:  0, //open app
+			ActionParameters: createIntercomContent(message),
+			OffLineTtl:       message.Ttl,
+		},
+	}
+	if channel := matchChannel(p.conf.Channels, message); channel != nil {
+		m.Notification.ChannelId = channel.ChannelId
+		m.Notification.Category = channel.Category
+		if len(channel.Category) > 0 {
+			m.Notification.NotifyLevel = oppoNotifyLockScreen
+		}
+	}
+	//do-not-disturb, channel of calls rings so it is not used
+	if message.Silent {
+		m.Notification.ChannelId = ""
+		m.Notification.NotifyLevel = oppoNotifyBar
+	}
+	return m
+}
+
+func (p *OppoProvider) Push(message *IntercomMessage) (*DeliveryResult, error) {
+	token, err := p.authToken()
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(p.createMessage(message))
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Add("message", string(data))
+	status, body, err := postForm(p.client, p.conf.Url+"/server/v1/message/notification/unicast",
+		map[string]string{"auth_token": token}, params)
+	if err != nil {
+		return nil, err
+	}
+	var r oppoResponse
+	if err = json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("invalid oppo response(%d): %s", status, string(body))
+	}
+	result := &DeliveryResult{
+		Provider:     ProviderOppo,
+		Success:      r.Code == 0,
+		Code:         r.Code,
+		Reason:       r.Message,
+		InvalidToken: r.Code == oppoInvalidRegId,
+		Raw:          string(body),
+	}
+	if r.Code == oppoInvalidAuthToken {
+		p.token.reset()
+		result.Retryable = true
+	} else if !result.Success {
+		result.Retryable = status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+	}
+	return result, nil
+}
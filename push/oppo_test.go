@@ -0,0 +1,88 @@
+package push
+
+import (
+	"encoding/json"
+	"jingxi.cn/transitservice/conf"
+	"jingxi.cn/transitservice/utils"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+const (
+	oppoTestSend = "/server/v1/message/notification/unicast"
+	oppoTestAuth = "/server/v1/auth"
+)
+
+var oppoTestAuthReply = map[string]fakeReply{
+	oppoTestAuth: {status: http.StatusOK, body: `{"code":0,"message":"Success","data":{"auth_token":"auth-1"}}`},
+}
+
+func newTestOppoProvider(serverUrl string) *OppoProvider {
+	return NewOppoProvider(conf.VendorPush{
+		Url:       serverUrl,
+		AppKey:    "app-key",
+		AppSecret: "master-secret",
+		Channels: []conf.PushChannel{
+			{Scheme: "call", ChannelId: "calls", Category: "IM"},
+		},
+	})
+}
+
+func TestOppoPush(t *testing.T) {
+	runResultCases(t, ProviderOppo, oppoTestSend, oppoTestAuthReply, []resultCase{
+		{"success", fakeReply{status: http.StatusOK, body: `{"code":0,"message":"Success","data":{"messageId":"1"}}`},
+			wantResult{success: true}},
+		{"invalid regid", fakeReply{status: http.StatusOK, body: `{"code":10000,"message":"Invalid RegistrationId"}`},
+			wantResult{invalidToken: true}},
+		{"server busy", fakeReply{status: http.StatusServiceUnavailable, body: `{"code":-1,"message":"Service Currently Unavailable"}`},
+			wantResult{retryable: true}},
+		{"invalid auth token", fakeReply{status: http.StatusOK, body: `{"code":11,"message":"Invalid AuthToken"}`},
+			wantResult{retryable: true}},
+		{"unparsable body", fakeReply{status: http.StatusBadGateway, body: `<html>bad gateway</html>`},
+			wantResult{err: true}},
+	}, func(serverUrl string) PushProvider {
+		return newTestOppoProvider(serverUrl)
+	})
+}
+
+func TestOppoRequest(t *testing.T) {
+	f := newFakePush(t, map[string]fakeReply{
+		oppoTestAuth: oppoTestAuthReply[oppoTestAuth],
+		oppoTestSend: {status: http.StatusOK, body: `{"code":0}`},
+	})
+	if _, err := newTestOppoProvider(f.URL).Push(newTestMessage()); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	auth, err := url.ParseQuery(f.received(oppoTestAuth)[0].Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Get("sign") != utils.Sha256String("app-key"+auth.Get("timestamp")+"master-secret") {
+		t.Errorf("auth params %v", auth)
+	}
+	request := f.received(oppoTestSend)[0]
+	if request.Header.Get("auth_token") != "auth-1" {
+		t.Errorf("auth_token %s", request.Header.Get("auth_token"))
+	}
+	params, err := url.ParseQuery(request.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m oppoMessage
+	if err = json.Unmarshal([]byte(params.Get("message")), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.TargetValue != "token-1" || m.Notification.ChannelId != "calls" || m.Notification.Category != "IM" {
+		t.Errorf("message %+v", m)
+	}
+}
+
+func TestOppoSilent(t *testing.T) {
+	message := newTestMessage()
+	message.Silent = true
+	n := newTestOppoProvider("").createMessage(message).Notification
+	if n.NotifyLevel != oppoNotifyBar || len(n.ChannelId) > 0 {
+		t.Errorf("notification %+v, want bar only without channel", n)
+	}
+}
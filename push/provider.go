@@ -0,0 +1,57 @@
+package push
+
+import "fmt"
+
+//normalized delivery result of push providers
+type DeliveryResult struct {
+	Provider     string `json:"provider"`
+	Target       string `json:"target"` //device token or account pushed to
+	Success      bool   `json:"success"`
+	Code         int    `json:"code"`         //provider code, e.g. yunxin code or http status
+	Reason       string `json:"reason"`       //provider error reason or description
+	Retryable    bool   `json:"retryable"`    //transient failure, send again later may succeed
+	InvalidToken bool   `json:"invalidToken"` //target token or account is dead
+	Raw          string `json:"raw"`          //provider response body
+	Dropped      bool   `json:"dropped"`      //message outlived its ttl and was not sent
+	Downgraded   bool   `json:"downgraded"`   //message outlived its ttl and was sent as missed call
+	Suppressed   bool   `json:"suppressed"`   //not sent in do-not-disturb time
+}
+
+//push channel such as Yunxin, APNs, FCM
+type PushProvider interface {
+	Name() string
+	//error is returned only when the provider was not reached or replied garbage
+	Push(message *IntercomMessage) (*DeliveryResult, error)
+}
+
+//provider which sends one content to many targets in one request
+type BatchProvider interface {
+	//results are in the order of messages, messages differ only in Device and User
+	//targets of a request which failed get retryable results, error is returned only when nothing was sent
+	PushBatch(messages []*IntercomMessage) ([]*DeliveryResult, error)
+}
+
+//provider which shows the content it sends, kept by dead letters for inspection
+type ContentRenderer interface {
+	Render(message *IntercomMessage) (map[string]string, error)
+}
+
+type UnknownProviderError struct {
+	Name string
+}
+
+func (e *UnknownProviderError) Error() string {
+	return fmt.Sprintf("unknown push provider: %s", e.Name)
+}
+
+type NoTargetError struct {
+	User string
+	Fid  string
+}
+
+func (e *NoTargetError) Error() string {
+	if len(e.User) < 1 {
+		return fmt.Sprintf("no valid push token of family: %s", e.Fid)
+	}
+	return fmt.Sprintf("no valid push token of user: %s", e.User)
+}
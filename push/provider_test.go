@@ -0,0 +1,167 @@
+package push
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+type fakeReply struct {
+	status int
+	body   string
+	header map[string]string
+}
+
+type fakeRequest struct {
+	Path   string
+	Header http.Header
+	Body   string
+}
+
+//fake provider server answering each path with its reply, unknown paths are 404
+type fakePush struct {
+	*httptest.Server
+	replies  map[string]fakeReply
+	requests []fakeRequest
+	mu       sync.Mutex
+}
+
+func newFakePush(t *testing.T, replies map[string]fakeReply) *fakePush {
+	f := &fakePush{replies: replies}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		f.mu.Lock()
+		f.requests = append(f.requests, fakeRequest{Path: r.URL.Path, Header: r.Header, Body: string(body)})
+		reply, ok := f.replies[r.URL.Path]
+		f.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		for k, v := range reply.header {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(reply.status)
+		_, _ = w.Write([]byte(reply.body))
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+//requests of path in order
+func (f *fakePush) received(path string) []fakeRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	requests := make([]fakeRequest, 0)
+	for _, v := range f.requests {
+		if v.Path == path {
+			requests = append(requests, v)
+		}
+	}
+	return requests
+}
+
+//delivery result expected of a provider reply
+type wantResult struct {
+	err          bool
+	success      bool
+	invalidToken bool
+	retryable    bool
+}
+
+type resultCase struct {
+	name  string
+	reply fakeReply
+	want  wantResult
+}
+
+//every case pushes once against a new fake server, auth replies are served along with the send path
+func runResultCases(t *testing.T, provider string, send string, auth map[string]fakeReply, cases []resultCase,
+	newProvider func(url string) PushProvider) {
+	for _, v := range cases {
+		t.Run(v.name, func(t *testing.T) {
+			replies := map[string]fakeReply{send: v.reply}
+			for path, reply := range auth {
+				replies[path] = reply
+			}
+			f := newFakePush(t, replies)
+			result, err := newProvider(f.URL).Push(newTestMessage())
+			if v.want.err {
+				if err == nil {
+					t.Fatalf("result %+v, want error", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Push: %v", err)
+			}
+			if result.Provider != provider {
+				t.Errorf("provider %s, want %s", result.Provider, provider)
+			}
+			if result.Success != v.want.success || result.InvalidToken != v.want.invalidToken ||
+				result.Retryable != v.want.retryable {
+				t.Errorf("result %+v, want %+v", result, v.want)
+			}
+			if len(result.Raw) < 1 {
+				t.Error("raw response empty")
+			}
+			if n := len(f.received(send)); n != 1 {
+				t.Errorf("%d requests of %s, want 1", n, send)
+			}
+		})
+	}
+}
+
+func newTestMessage() *IntercomMessage {
+	return &IntercomMessage{
+		Device:     "token-1",
+		Cid:        "cid-1",
+		Fid:        "fid-1",
+		Scheme:     "call",
+		Cmd:        "ring",
+		CreateTime: 1700000000,
+		Title:      "Door station",
+		Body:       "Someone is at the door",
+	}
+}
+
+func newTestEcdsaKey(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encodeTestKey(t, key)
+}
+
+var (
+	testRsaKey     *rsa.PrivateKey
+	testRsaKeyOnce sync.Once
+)
+
+//rsa key generation is slow, tests share one
+func newTestRsaKey(t *testing.T) []byte {
+	testRsaKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testRsaKey = key
+	})
+	return encodeTestKey(t, testRsaKey)
+}
+
+func encodeTestKey(t *testing.T, key interface{}) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
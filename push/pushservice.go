@@ -1,103 +1,296 @@
 package push
 
 import (
-	"bytes"
-	"crypto/sha1"
-	"encoding/hex"
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
 	"jingxi.cn/transitservice/conf"
-	"jingxi.cn/transitservice/utils"
-	"net/http"
-	"net/url"
-	"strconv"
+	"jingxi.cn/transitservice/registry"
+	"path/filepath"
 	"strings"
 	"time"
 )
 
+//dispatch intercom message to push providers
 type PushService struct {
 	serverConf *conf.ServerConfig
+	providers  map[string]PushProvider
+	fallback   string //provider used when message does not name one
+	tokens     *registry.TokenRegistry
+	dnd        *registry.DndRegistry
 }
 
-func NewPushService(conf *conf.ServerConfig) *PushService {
-	return &PushService{
+func NewPushService(conf *conf.ServerConfig, confDir string) (*PushService, error) {
+	p := &PushService{
 		serverConf: conf,
+		providers:  make(map[string]PushProvider),
+		fallback:   "",
+		tokens:     nil,
+		dnd:        nil,
 	}
+	if conf.IsSupportYunxin() {
+		p.AddProvider(NewYunxinProvider(conf))
+	}
+	if conf.IsSupportApns() {
+		keyData, err := ioutil.ReadFile(confPath(confDir, conf.Apns.KeyFile))
+		if err != nil {
+			return nil, err
+		}
+		apns, err := NewApnsProvider(conf.Apns, keyData)
+		if err != nil {
+			return nil, err
+		}
+		p.AddProvider(apns)
+	}
+	if conf.IsSupportFcm() {
+		keyData, err := ioutil.ReadFile(confPath(confDir, conf.Fcm.KeyFile))
+		if err != nil {
+			return nil, err
+		}
+		fcm, err := NewFcmProvider(conf.Fcm, keyData)
+		if err != nil {
+			return nil, err
+		}
+		p.AddProvider(fcm)
+	}
+	if conf.IsSupportHuawei() {
+		p.AddProvider(NewHuaweiProvider(conf.Huawei))
+	}
+	if conf.IsSupportXiaomi() {
+		p.AddProvider(NewXiaomiProvider(conf.Xiaomi))
+	}
+	if conf.IsSupportOppo() {
+		p.AddProvider(NewOppoProvider(conf.Oppo))
+	}
+	if conf.IsSupportVivo() {
+		p.AddProvider(NewVivoProvider(conf.Vivo))
+	}
+	return p, nil
 }
 
-//remove tail char '_'
-func getAccount(pushId string) string {
-	for i := len(pushId) - 1; i >= 0; i-- {
-		if pushId[i] == '_' {
-			return pushId[:i]
+//relative path is relative to conf directory
+func confPath(confDir string, file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(confDir, file)
+}
+
+//the first added provider is used when message does not name one
+func (p *PushService) AddProvider(provider PushProvider) {
+	p.providers[provider.Name()] = provider
+	if len(p.fallback) < 1 {
+		p.fallback = provider.Name()
+	}
+}
+
+func (p *PushService) Provider(name string) (PushProvider, error) {
+	if len(name) < 1 {
+		name = p.fallback
+	}
+	if v, ok := p.providers[strings.ToLower(name)]; ok {
+		return v, nil
+	}
+	return nil, &UnknownProviderError{Name: name}
+}
+
+//resolve users to tokens and invalidate dead tokens
+func (p *PushService) SetTokenRegistry(tokens *registry.TokenRegistry) {
+	p.tokens = tokens
+}
+
+//schedules consulted before sending
+func (p *PushService) SetDndRegistry(dnd *registry.DndRegistry) {
+	p.dnd = dnd
+}
+
+//messages per target, message to user or family is copied for each valid token
+func (p *PushService) Resolve(message *IntercomMessage) ([]*IntercomMessage, error) {
+	if !message.IsFanOut() || p.tokens == nil {
+		return []*IntercomMessage{message}, nil
+	}
+	var tokens []*registry.PushToken
+	if len(message.User) > 0 {
+		tokens = p.tokens.FindByUser(message.User)
+	} else {
+		tokens = p.tokens.FindByFamily(message.Fid)
+	}
+	if len(tokens) < 1 {
+		return nil, &NoTargetError{User: message.User, Fid: message.Fid}
+	}
+	messages := make([]*IntercomMessage, 0, len(tokens))
+	for _, v := range tokens {
+		m := *message
+		m.Device = v.Token
+		m.Provider = v.Provider
+		m.User = v.UserId
+		if len(m.Locale) < 1 {
+			m.Locale = v.Locale
 		}
+		messages = append(messages, &m)
 	}
-	return pushId
+	return messages, nil
 }
 
-//https://doc.yunxin.163.com/messaging/docs/jYxMjQ1NTk?platform=server
-func (p *PushService) Push(message *IntercomMessage) ([]byte, error) {
-	attachBytes, err := CreateAttach(p.serverConf.Push.MsgTag, message)
+//push to message.Device by message.Provider
+//ttl and do-not-disturb rules are checked on every send and retry
+func (p *PushService) Push(message *IntercomMessage) (*DeliveryResult, error) {
+	provider, err := p.Provider(message.Provider)
 	if err != nil {
 		return nil, err
 	}
-	payloadBytes, err := CreatePayload(message)
+	send, downgraded, result := p.prepare(provider, message)
+	if result != nil {
+		return result, nil
+	}
+	result, err = provider.Push(send)
 	if err != nil {
+		logrus.Errorf("push to %s error: %+v", provider.Name(), err)
 		return nil, err
 	}
-	params := url.Values{}
-	params.Add("attach", string(attachBytes))
-	params.Add("pushcontent", message.Body)
-	params.Add("payload", string(payloadBytes))
-	params.Add("msgtype", "0") //0：点对点自定义通知
-	params.Add("from", p.serverConf.Push.AppAccid)
-	params.Add("to", getAccount(message.Device))
+	result.Downgraded = downgraded
+	p.checkResult(provider, message, result)
+	return result, nil
+}
 
-	if len(p.serverConf.Push.Save) > 0 {
-		params.Add("save", p.serverConf.Push.Save)
+//copy of message to send and whether it was downgraded, result is returned instead when message is not sent
+func (p *PushService) prepare(provider PushProvider, message *IntercomMessage) (*IntercomMessage, bool, *DeliveryResult) {
+	send, downgraded := expireMessage(p.serverConf.Ttl, message)
+	if send == nil {
+		logrus.Infof("push to %s dropped, message(%s %s) expired", message.Device, message.Scheme, message.Cmd)
+		return nil, false, expiredResult(provider.Name(), message)
+	}
+	if !p.isQuiet(provider, message) {
+		return send, downgraded, nil
+	}
+	switch strings.ToLower(p.serverConf.Dnd.Action) {
+	case conf.DndActionDeliver:
+	case conf.DndActionSuppress:
+		logrus.Infof("push to %s suppressed by do-not-disturb", message.Device)
+		return nil, downgraded, &DeliveryResult{
+			Provider:   provider.Name(),
+			Target:     message.Device,
+			Reason:     "do not disturb",
+			Downgraded: downgraded,
+			Suppressed: true,
+		}
+	default:
+		send.Silent = true
 	}
+	return send, downgraded, nil
+}
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+//do-not-disturb schedule of user or family of the target token is active
+func (p *PushService) isQuiet(provider PushProvider, message *IntercomMessage) bool {
+	if p.dnd == nil {
+		return false
 	}
-	req, err := http.NewRequest("POST", p.serverConf.Push.SendAttachMsgUrl, bytes.NewBuffer([]byte(params.Encode())))
-	if err != nil {
-		return nil, err
+	user, fid := message.User, message.Fid
+	if len(user) < 1 && p.tokens != nil {
+		tokens := p.tokens.Find(func(t *registry.PushToken) bool {
+			return t.Provider == provider.Name() && t.Token == message.Device
+		})
+		if len(tokens) > 0 {
+			user = tokens[0].UserId
+			if len(fid) < 1 {
+				fid = tokens[0].FamilyId
+			}
+		}
 	}
-	p.addHeader(req)
+	return p.dnd.IsQuiet(user, fid, message.Scheme, time.Now())
+}
+
+func (p *PushService) checkResult(provider PushProvider, message *IntercomMessage, result *DeliveryResult) {
+	result.Target = message.Device
+	if result.InvalidToken && p.tokens != nil {
+		p.tokens.Invalidate(provider.Name(), message.Device, result.Reason)
+	}
+}
 
-	resp, err := client.Do(req)
+//messages of a batch provider sent together share content
+//content is the message to send without device and user, which Resolve sets per token,
+//so rendered title, body, sound, category, locale, silent and ttl all match
+type batchKey struct {
+	provider   string
+	downgraded bool
+	content    IntercomMessage
+}
+
+//push each message, messages of a batch provider are sent together
+//results are in the order of messages, error is returned as a retryable result unless provider is unknown
+func (p *PushService) PushAll(messages []*IntercomMessage) []*DeliveryResult {
+	results := make([]*DeliveryResult, len(messages))
+	batches := make(map[batchKey][]int)
+	sends := make([]*IntercomMessage, len(messages))
+	for k, m := range messages {
+		provider, err := p.Provider(m.Provider)
+		if err == nil {
+			if _, ok := provider.(BatchProvider); ok {
+				send, downgraded, result := p.prepare(provider, m)
+				if result != nil {
+					results[k] = result
+					continue
+				}
+				sends[k] = send
+				key := batchKey{provider: provider.Name(), downgraded: downgraded, content: *send}
+				key.content.Device = ""
+				key.content.User = ""
+				batches[key] = append(batches[key], k)
+				continue
+			}
+		}
+		result, err := p.Push(m)
+		results[k] = errorResult(m, result, err)
+	}
+	for key, indexes := range batches {
+		provider := p.providers[key.provider]
+		batch := make([]*IntercomMessage, 0, len(indexes))
+		for _, k := range indexes {
+			batch = append(batch, sends[k])
+		}
+		batchResults, err := provider.(BatchProvider).PushBatch(batch)
+		if err != nil {
+			logrus.Errorf("batch push to %s error: %+v", key.provider, err)
+		}
+		for i, k := range indexes {
+			if err != nil {
+				results[k] = errorResult(messages[k], nil, err)
+				continue
+			}
+			batchResults[i].Downgraded = key.downgraded
+			p.checkResult(provider, messages[k], batchResults[i])
+			results[k] = batchResults[i]
+		}
+	}
+	return results
+}
+
+func errorResult(message *IntercomMessage, result *DeliveryResult, err error) *DeliveryResult {
+	if err == nil {
+		return result
+	}
+	_, unknown := err.(*UnknownProviderError)
+	return &DeliveryResult{
+		Provider:  message.Provider,
+		Target:    message.Device,
+		Reason:    err.Error(),
+		Retryable: !unknown,
+	}
+}
+
+//content provider of message sends, nil if provider can not render it
+func (p *PushService) Render(message *IntercomMessage) map[string]string {
+	provider, err := p.Provider(message.Provider)
 	if err != nil {
-		logrus.Errorf("Request(%+v) error: %+v", params, err)
-		return nil, err
+		return nil
+	}
+	renderer, ok := provider.(ContentRenderer)
+	if !ok {
+		return nil
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	content, err := renderer.Render(message)
 	if err != nil {
-		return nil, err
+		logrus.Errorf("render push content of %s error: %+v", provider.Name(), err)
+		return nil
 	}
-	return body, nil
-}
-
-//https://doc.yunxin.163.com/TM5MzM5Njk/docs/jk3MzY2MTI?platform=server
-func (p *PushService) addHeader(req *http.Request) {
-	nonce := utils.RandString(16)
-	curTime := strconv.FormatInt(time.Now().Unix(), 10)
-	chechSum := checkSum(p.serverConf.Push.AppSecret, nonce, curTime)
-	req.Header.Add("AppKey", p.serverConf.Push.AppKey)
-	req.Header.Add("Nonce", nonce)
-	req.Header.Add("CurTime", curTime)
-	req.Header.Add("CheckSum", chechSum)
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded;charset=utf-8")
-}
-
-//SHA1(AppSecret + Nonce + CurTime)
-func checkSum(a string, b string, c string) string {
-	var builder strings.Builder
-	builder.WriteString(a)
-	builder.WriteString(b)
-	builder.WriteString(c)
-	o := sha1.New()
-	o.Write([]byte(builder.String()))
-	return hex.EncodeToString(o.Sum(nil))
+	return content
 }
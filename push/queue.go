@@ -0,0 +1,347 @@
+package push
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"jingxi.cn/transitservice/conf"
+	"jingxi.cn/transitservice/utils"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueueWorkers     = 4
+	defaultQueueMaxAttempts = 5
+	defaultQueueBaseDelay   = 1000
+	defaultQueueMaxDelay    = 60000
+
+	queuePollInterval = 200 * time.Millisecond
+)
+
+//one delivery try of a job
+type Attempt struct {
+	Time   int64           `json:"time"` //unix milliseconds
+	Result *DeliveryResult `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+//queued push to one target, stored as <dir>/<id>.json until finished
+type Job struct {
+	Id         string          `json:"id"`
+	MessageId  string          `json:"messageId"`           //jobs of the same /push request share it
+	Broadcast  string          `json:"broadcast,omitempty"` //id of broadcast the job pushes for
+	Message    IntercomMessage `json:"message"`
+	Attempts   []Attempt       `json:"attempts"`
+	NextTime   int64           `json:"nextTime"` //unix milliseconds of next try
+	CreateTime int64           `json:"createTime"`
+}
+
+func NewJob(messageId string, message *IntercomMessage) *Job {
+	now := nowMillis()
+	return &Job{
+		Id:         newJobId(),
+		MessageId:  messageId,
+		Message:    *message,
+		NextTime:   now,
+		CreateTime: now,
+	}
+}
+
+func (j *Job) AddAttempt(result *DeliveryResult, err error) {
+	attempt := Attempt{Time: nowMillis(), Result: result}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	j.Attempts = append(j.Attempts, attempt)
+}
+
+//result of the last attempt, nil if provider was not reached
+func (j *Job) LastResult() *DeliveryResult {
+	if len(j.Attempts) < 1 {
+		return nil
+	}
+	return j.Attempts[len(j.Attempts)-1].Result
+}
+
+//durable queue, workers deliver jobs with exponential backoff and jitter
+type PushQueue struct {
+	dir      string
+	conf     conf.Queue
+	service  *PushService
+	jobs     map[string]*Job
+	inflight map[string]bool
+	onFailed func(job *Job) //called when job exhausted retries or failed permanently
+	onFinish func(job *Job) //called when job leaves the queue for any reason
+	tasks    chan []*Job
+	quit     chan struct{}
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+}
+
+func NewPushQueue(c conf.Queue, dir string, service *PushService) (*PushQueue, error) {
+	if c.Workers < 1 {
+		c.Workers = defaultQueueWorkers
+	}
+	if c.MaxAttempts < 1 {
+		c.MaxAttempts = defaultQueueMaxAttempts
+	}
+	if c.BaseDelay < 1 {
+		c.BaseDelay = defaultQueueBaseDelay
+	}
+	if c.MaxDelay < c.BaseDelay {
+		c.MaxDelay = defaultQueueMaxDelay
+	}
+	q := &PushQueue{
+		dir:      dir,
+		conf:     c,
+		service:  service,
+		jobs:     make(map[string]*Job),
+		inflight: make(map[string]bool),
+		tasks:    make(chan []*Job),
+		quit:     make(chan struct{}),
+	}
+	return q, q.load()
+}
+
+//jobs left by last run are delivered again
+func (q *PushQueue) load() error {
+	err := os.MkdirAll(q.dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		var job Job
+		_, err = utils.LoadJsonFile(filepath.Join(q.dir, f.Name()), &job)
+		if err != nil {
+			logrus.Errorf("load push job(%s) error: %+v", f.Name(), err)
+			continue
+		}
+		q.jobs[job.Id] = &job
+	}
+	logrus.Infof("%d push jobs loaded from %s", len(q.jobs), q.dir)
+	return nil
+}
+
+func (q *PushQueue) SetFailedHandler(handler func(job *Job)) {
+	q.onFailed = handler
+}
+
+//handler gets delivered, dropped and failed jobs, outcome is job.LastResult()
+func (q *PushQueue) SetFinishedHandler(handler func(job *Job)) {
+	q.onFinish = handler
+}
+
+//jobs are delivered by service from now on, e.g. after configuration reload
+func (q *PushQueue) SetService(service *PushService) {
+	q.mu.Lock()
+	q.service = service
+	q.mu.Unlock()
+}
+
+func (q *PushQueue) Start() {
+	for i := 0; i < q.conf.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	q.wg.Add(1)
+	go q.schedule()
+}
+
+//wait for inflight deliveries, queued jobs stay on disk
+func (q *PushQueue) Stop() {
+	close(q.quit)
+	q.wg.Wait()
+}
+
+func newJobId() string {
+	return fmt.Sprintf("%d%s", time.Now().UnixNano(), utils.RandString(6))
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+//enqueue one job per message, returns the message id shared by the jobs
+//jobs sharing the message id which are due together are delivered by PushAll
+//jobs are scheduled only when all are saved, saved ones are removed again on error so a retry does not push twice
+func (q *PushQueue) Enqueue(messages []*IntercomMessage) (string, []string, error) {
+	return q.enqueue("", messages)
+}
+
+//enqueue messages of one family of broadcast, finished jobs are reported with its id
+func (q *PushQueue) EnqueueBroadcast(broadcast string, messages []*IntercomMessage) (string, []string, error) {
+	return q.enqueue(broadcast, messages)
+}
+
+func (q *PushQueue) enqueue(broadcast string, messages []*IntercomMessage) (string, []string, error) {
+	messageId := newJobId()
+	jobs := make([]*Job, 0, len(messages))
+	for _, m := range messages {
+		job := NewJob(messageId, m)
+		job.Broadcast = broadcast
+		if err := q.save(job); err != nil {
+			for _, v := range jobs {
+				q.remove(v)
+			}
+			return messageId, nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	ids := make([]string, 0, len(jobs))
+	q.mu.Lock()
+	for _, job := range jobs {
+		q.jobs[job.Id] = job
+		ids = append(ids, job.Id)
+	}
+	q.mu.Unlock()
+	return messageId, ids, nil
+}
+
+//synced to disk, queued pushes survive power loss
+func (q *PushQueue) save(job *Job) error {
+	return utils.SyncJsonFile(filepath.Join(q.dir, job.Id+".json"), job)
+}
+
+func (q *PushQueue) remove(job *Job) {
+	q.mu.Lock()
+	delete(q.jobs, job.Id)
+	delete(q.inflight, job.Id)
+	q.mu.Unlock()
+	if err := os.Remove(filepath.Join(q.dir, job.Id+".json")); err != nil && !os.IsNotExist(err) {
+		logrus.Errorf("remove push job(%s) error: %+v", job.Id, err)
+	}
+}
+
+func (q *PushQueue) schedule() {
+	defer q.wg.Done()
+	ticker := time.NewTicker(queuePollInterval)
+	defer ticker.Stop()
+	for {
+		for _, jobs := range q.dueJobs() {
+			select {
+			case q.tasks <- jobs:
+			case <-q.quit:
+				close(q.tasks)
+				return
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-q.quit:
+			close(q.tasks)
+			return
+		}
+	}
+}
+
+//due jobs grouped by message id, jobs of a fan-out due together are sent by batch api
+func (q *PushQueue) dueJobs() [][]*Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := nowMillis()
+	groups := make(map[string]int)
+	var jobs [][]*Job
+	for id, job := range q.jobs {
+		if q.inflight[id] || job.NextTime > now {
+			continue
+		}
+		q.inflight[id] = true
+		if k, ok := groups[job.MessageId]; ok && len(job.MessageId) > 0 {
+			jobs[k] = append(jobs[k], job)
+			continue
+		}
+		groups[job.MessageId] = len(jobs)
+		jobs = append(jobs, []*Job{job})
+	}
+	return jobs
+}
+
+func (q *PushQueue) work() {
+	defer q.wg.Done()
+	for jobs := range q.tasks {
+		q.deliver(jobs)
+	}
+}
+
+//every job keeps its own attempts, retries and dead letter
+func (q *PushQueue) deliver(jobs []*Job) {
+	q.mu.Lock()
+	service := q.service
+	q.mu.Unlock()
+	if len(jobs) == 1 {
+		result, err := service.Push(&jobs[0].Message)
+		q.finish(jobs[0], result, err)
+		return
+	}
+	messages := make([]*IntercomMessage, 0, len(jobs))
+	for _, job := range jobs {
+		messages = append(messages, &job.Message)
+	}
+	for k, result := range service.PushAll(messages) {
+		q.finish(jobs[k], result, nil)
+	}
+}
+
+func (q *PushQueue) finish(job *Job, result *DeliveryResult, err error) {
+	job.AddAttempt(result, err)
+
+	if err == nil && result.Success {
+		logrus.Infof("push job(%s) delivered by %s after %d attempts", job.Id, result.Provider, len(job.Attempts))
+		q.finished(job)
+		return
+	}
+	//downgraded missed call is delivered or retried like any other push
+	if err == nil && (result.Dropped || result.Suppressed) {
+		logrus.Infof("push job(%s) dropped, message expired or suppressed", job.Id)
+		q.finished(job)
+		return
+	}
+	_, unknown := err.(*UnknownProviderError)
+	retryable := (err != nil && !unknown) || (result != nil && result.Retryable)
+	if retryable && len(job.Attempts) < q.conf.MaxAttempts {
+		job.NextTime = nowMillis() + q.backoff(len(job.Attempts))
+		if err := q.save(job); err != nil {
+			logrus.Errorf("save push job(%s) error: %+v", job.Id, err)
+		}
+		q.mu.Lock()
+		delete(q.inflight, job.Id)
+		q.mu.Unlock()
+		return
+	}
+	logrus.Errorf("push job(%s) to %s failed after %d attempts", job.Id, job.Message.Device, len(job.Attempts))
+	if q.onFailed != nil {
+		q.onFailed(job)
+	}
+	q.finished(job)
+}
+
+func (q *PushQueue) finished(job *Job) {
+	q.remove(job)
+	if q.onFinish != nil {
+		q.onFinish(job)
+	}
+}
+
+//milliseconds before next try, exponential with jitter in [delay/2, delay]
+func (q *PushQueue) backoff(attempts int) int64 {
+	delay := int64(q.conf.BaseDelay)
+	for i := 1; i < attempts && delay < int64(q.conf.MaxDelay); i++ {
+		delay *= 2
+	}
+	if delay > int64(q.conf.MaxDelay) {
+		delay = int64(q.conf.MaxDelay)
+	}
+	return delay/2 + rand.Int63n(delay/2+1)
+}
@@ -0,0 +1,134 @@
+package push
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	MatchExact    = "exact"
+	MatchPrefix   = "prefix"
+	MatchWildcard = "wildcard" //* is any characters, ? is one character
+	MatchRegex    = "regex"
+)
+
+//condition on a field of intercom message, exact, prefix and wildcard ignore case
+type Condition struct {
+	Field string `json:"field"` //json name of IntercomMessage field, e.g. scheme, cmd, fid
+	Match string `json:"match"` //exact, prefix, wildcard or regex, default exact
+	Value string `json:"value"`
+	re    *regexp.Regexp
+}
+
+//text of messages matched all conditions, empty value keeps the keyword replacement
+type KeywordRule struct {
+	Name       string      `json:"name"`
+	Priority   int         `json:"priority"` //higher is tried first, equal keeps file order
+	Conditions []Condition `json:"when"`
+	Title      string      `json:"title"`
+	Body       string      `json:"body"`
+	Sound      string      `json:"sound"`
+	Category   string      `json:"category"`
+	title      *Template
+	body       *Template
+}
+
+//value of message field by json name
+func fieldValue(message *IntercomMessage, field string) (string, bool) {
+	switch strings.ToLower(field) {
+	case "device":
+		return message.Device, true
+	case "platform":
+		return strconv.Itoa(message.Platform), true
+	case "cid":
+		return message.Cid, true
+	case "fid":
+		return message.Fid, true
+	case "scheme":
+		return message.Scheme, true
+	case "cmd":
+		return message.Cmd, true
+	case "time":
+		return strconv.FormatFloat(message.CreateTime, 'f', -1, 64), true
+	case "title":
+		return message.Title, true
+	case "body":
+		return message.Body, true
+	case "ack":
+		return strconv.FormatBool(message.Ack), true
+	case "result":
+		return strconv.Itoa(message.Result), true
+	case "message":
+		return message.Message, true
+	case "user":
+		return message.User, true
+	case "provider":
+		return message.Provider, true
+	}
+	return "", false
+}
+
+func (c *Condition) compile() error {
+	if _, ok := fieldValue(&IntercomMessage{}, c.Field); !ok {
+		return fmt.Errorf("unknown field %s", c.Field)
+	}
+	var err error
+	switch strings.ToLower(c.Match) {
+	case "", MatchExact, MatchPrefix:
+	case MatchWildcard:
+		pattern := regexp.QuoteMeta(c.Value)
+		pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+		pattern = strings.ReplaceAll(pattern, `\?`, ".")
+		c.re, err = regexp.Compile("(?i)^" + pattern + "$")
+	case MatchRegex:
+		c.re, err = regexp.Compile(c.Value)
+	default:
+		return fmt.Errorf("unknown match %s of field %s", c.Match, c.Field)
+	}
+	return err
+}
+
+func (c *Condition) match(message *IntercomMessage) bool {
+	value, _ := fieldValue(message, c.Field)
+	switch strings.ToLower(c.Match) {
+	case MatchPrefix:
+		return strings.HasPrefix(strings.ToLower(value), strings.ToLower(c.Value))
+	case MatchWildcard, MatchRegex:
+		return c.re.MatchString(value)
+	}
+	return strings.EqualFold(value, c.Value)
+}
+
+func (r *KeywordRule) match(message *IntercomMessage) bool {
+	for k := range r.Conditions {
+		if !r.Conditions[k].match(message) {
+			return false
+		}
+	}
+	return true
+}
+
+//compile conditions and text templates, sort rules by priority
+func compileRules(rules []KeywordRule) error {
+	var err error
+	for i := range rules {
+		for k := range rules[i].Conditions {
+			if err = rules[i].Conditions[k].compile(); err != nil {
+				return fmt.Errorf("rule %d(%s): %v", i, rules[i].Name, err)
+			}
+		}
+		if rules[i].title, err = compileTemplate(rules[i].Title); err != nil {
+			return fmt.Errorf("rule %d(%s): %v", i, rules[i].Name, err)
+		}
+		if rules[i].body, err = compileTemplate(rules[i].Body); err != nil {
+			return fmt.Errorf("rule %d(%s): %v", i, rules[i].Name, err)
+		}
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority > rules[j].Priority
+	})
+	return nil
+}
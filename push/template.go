@@ -0,0 +1,122 @@
+package push
+
+import (
+	"fmt"
+	"jingxi.cn/transitservice/registry"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//placeholders of notification text, {name} or {name|fallback}, {{ and }} are literal braces
+var templateNames = map[string]bool{
+	"cid":       true,
+	"fid":       true,
+	"scheme":    true,
+	"cmd":       true,
+	"result":    true,
+	"device":    true,
+	"user":      true,
+	"aliasName": true, //device registry of message cid
+	"number":    true, //room number
+	"community": true,
+	"building":  true,
+	"unit":      true,
+}
+
+type templatePart struct {
+	text     string
+	name     string //placeholder when not empty
+	fallback string
+}
+
+//notification text compiled once when keyword is loaded
+type Template struct {
+	parts []templatePart
+}
+
+func compileTemplate(s string) (*Template, error) {
+	t := &Template{}
+	var text strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "{{"):
+			text.WriteByte('{')
+			i++
+		case strings.HasPrefix(s[i:], "}}"):
+			text.WriteByte('}')
+			i++
+		case s[i] == '}':
+			return nil, fmt.Errorf("unexpected } at %d of %q", i, s)
+		case s[i] == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed { at %d of %q", i, s)
+			}
+			part := templatePart{name: s[i+1 : i+end]}
+			if k := strings.IndexByte(part.name, '|'); k >= 0 {
+				part.fallback = part.name[k+1:]
+				part.name = part.name[:k]
+			}
+			part.name = strings.TrimSpace(part.name)
+			if !templateNames[part.name] {
+				return nil, fmt.Errorf("unknown placeholder {%s} of %q", part.name, s)
+			}
+			if text.Len() > 0 {
+				t.parts = append(t.parts, templatePart{text: text.String()})
+				text.Reset()
+			}
+			t.parts = append(t.parts, part)
+			i += end
+		default:
+			text.WriteByte(s[i])
+		}
+	}
+	if text.Len() > 0 {
+		t.parts = append(t.parts, templatePart{text: text.String()})
+	}
+	return t, nil
+}
+
+//control characters of values are removed, values are not expanded again
+func (t *Template) Execute(vars map[string]string) string {
+	var b strings.Builder
+	for _, v := range t.parts {
+		if len(v.name) < 1 {
+			b.WriteString(v.text)
+			continue
+		}
+		value := strings.TrimSpace(strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, vars[v.name]))
+		if len(value) < 1 {
+			value = v.fallback
+		}
+		b.WriteString(value)
+	}
+	return b.String()
+}
+
+//placeholder values of message, device may be nil
+func templateVars(message *IntercomMessage, device *registry.Device) map[string]string {
+	vars := map[string]string{
+		"cid":    message.Cid,
+		"fid":    message.Fid,
+		"scheme": message.Scheme,
+		"cmd":    message.Cmd,
+		"result": strconv.Itoa(message.Result),
+		"device": message.Device,
+		"user":   message.User,
+	}
+	if device != nil {
+		vars["aliasName"] = device.AliasName
+		vars["number"] = device.Number
+		vars["community"] = device.Community
+		vars["building"] = device.Building
+		vars["unit"] = device.Unit
+	}
+	return vars
+}
@@ -0,0 +1,75 @@
+package push
+
+import (
+	"sync"
+	"time"
+)
+
+const tokenRefreshAhead = time.Minute
+
+//refresh in progress, callers arriving meanwhile wait for its result
+type tokenFetch struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+//access token of provider api, refreshed a little before it expires
+//the refresh runs outside the lock and only once at a time
+type tokenCache struct {
+	token  string
+	expire time.Time
+	ahead  time.Duration //refresh this long before token expires, 0 is tokenRefreshAhead
+	fetch  *tokenFetch   //nil if no refresh is running
+	mu     sync.Mutex
+}
+
+//refresh returns a new token and its lifetime
+func (t *tokenCache) get(refresh func() (string, time.Duration, error)) (string, error) {
+	t.mu.Lock()
+	if len(t.token) > 0 && time.Now().Before(t.expire) {
+		token := t.token
+		t.mu.Unlock()
+		return token, nil
+	}
+	if f := t.fetch; f != nil {
+		t.mu.Unlock()
+		<-f.done
+		return f.token, f.err
+	}
+	f := &tokenFetch{done: make(chan struct{})}
+	t.fetch = f
+	t.mu.Unlock()
+
+	f.token, f.err = t.refresh(refresh)
+	close(f.done)
+	return f.token, f.err
+}
+
+func (t *tokenCache) refresh(refresh func() (string, time.Duration, error)) (string, error) {
+	token, lifetime, err := refresh()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fetch = nil
+	if err != nil {
+		return "", err
+	}
+	ahead := t.ahead
+	if ahead <= 0 {
+		ahead = tokenRefreshAhead
+	}
+	//short lived token is refreshed at half of its lifetime
+	if lifetime <= ahead {
+		ahead = lifetime / 2
+	}
+	t.token = token
+	t.expire = time.Now().Add(lifetime - ahead)
+	return token, nil
+}
+
+//provider rejected the token, next get refreshes it
+func (t *tokenCache) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.token = ""
+}
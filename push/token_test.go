@@ -0,0 +1,98 @@
+package push
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenCacheSingleFlight(t *testing.T) {
+	var cache tokenCache
+	var calls int32
+	release := make(chan struct{})
+	refresh := func() (string, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "token-1", time.Hour, nil
+	}
+	var wg sync.WaitGroup
+	tokens := make([]string, 10)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], _ = cache.get(refresh)
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("%d refreshes, want 1", calls)
+	}
+	for _, v := range tokens {
+		if v != "token-1" {
+			t.Fatalf("tokens %v", tokens)
+		}
+	}
+}
+
+//a slow refresh holds no lock, a valid token is answered meanwhile
+func TestTokenCacheRefreshOutsideLock(t *testing.T) {
+	var cache tokenCache
+	if _, err := cache.get(func() (string, time.Duration, error) { return "token-1", time.Hour, nil }); err != nil {
+		t.Fatal(err)
+	}
+	cache.reset()
+	release := make(chan struct{})
+	go func() {
+		_, _ = cache.get(func() (string, time.Duration, error) {
+			<-release
+			return "token-2", time.Hour, nil
+		})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		cache.reset()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reset blocked by refresh")
+	}
+	close(release)
+}
+
+func TestTokenCacheError(t *testing.T) {
+	var cache tokenCache
+	failed := errors.New("auth endpoint down")
+	if _, err := cache.get(func() (string, time.Duration, error) { return "", 0, failed }); err != failed {
+		t.Fatalf("error %v, want %v", err, failed)
+	}
+	token, err := cache.get(func() (string, time.Duration, error) { return "token-1", time.Hour, nil })
+	if err != nil || token != "token-1" {
+		t.Fatalf("token %s %v after failed refresh", token, err)
+	}
+}
+
+func TestTokenCacheRefreshAhead(t *testing.T) {
+	cache := tokenCache{ahead: apnsTokenRefreshAhead}
+	if _, err := cache.get(func() (string, time.Duration, error) { return "token-1", apnsTokenLifetime, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if left := time.Until(cache.expire); left > 50*time.Minute || left < 49*time.Minute {
+		t.Errorf("token used for %v, want 50 minutes", left)
+	}
+	//lifetime shorter than the margin is refreshed at half of it
+	cache = tokenCache{}
+	if _, err := cache.get(func() (string, time.Duration, error) { return "token-1", 30 * time.Second, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if left := time.Until(cache.expire); left > 15*time.Second || left < 14*time.Second {
+		t.Errorf("token used for %v, want 15 seconds", left)
+	}
+}
@@ -0,0 +1,61 @@
+package push
+
+import (
+	"jingxi.cn/transitservice/conf"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//the most specific ttl rule of message scheme and cmd, nil if none matches
+func matchTtlRule(rules []conf.TtlRule, message *IntercomMessage) *conf.TtlRule {
+	var found *conf.TtlRule
+	best := -1
+	for k, v := range rules {
+		if score := matchScore(v.Scheme, v.Cmd, message); score > best {
+			found = &rules[k]
+			best = score
+		}
+	}
+	return found
+}
+
+//copy of message to send with seconds left to live, nil if it expired and is dropped
+//expired message of missed action is downgraded to missed call notification without ttl
+func expireMessage(rules []conf.TtlRule, message *IntercomMessage) (*IntercomMessage, bool) {
+	m := *message
+	rule := matchTtlRule(rules, message)
+	if rule == nil || rule.Ttl < 1 || message.CreateTime <= 0 {
+		return &m, false
+	}
+	now := float64(time.Now().UnixNano() / int64(time.Millisecond))
+	left := float64(rule.Ttl)*1000 - (now - message.CreateTime)
+	if left > 0 {
+		m.Ttl = int((left + 999) / 1000)
+		return &m, false
+	}
+	if !strings.EqualFold(rule.Action, conf.TtlActionMissed) {
+		return nil, true
+	}
+	if len(rule.MissedTitle) > 0 {
+		m.Title = rule.MissedTitle
+	}
+	if len(rule.MissedBody) > 0 {
+		m.Body = rule.MissedBody
+	}
+	if len(rule.MissedCmd) > 0 {
+		m.Cmd = rule.MissedCmd
+	}
+	m.Ttl = 0
+	return &m, true
+}
+
+func expiredResult(provider string, message *IntercomMessage) *DeliveryResult {
+	return &DeliveryResult{
+		Provider: provider,
+		Target:   message.Device,
+		Code:     http.StatusGone,
+		Reason:   "message expired",
+		Dropped:  true,
+	}
+}
@@ -0,0 +1,93 @@
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"jingxi.cn/transitservice/conf"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//the most specific channel of message scheme and cmd, nil if none matches
+func matchChannel(channels []conf.PushChannel, message *IntercomMessage) *conf.PushChannel {
+	var found *conf.PushChannel
+	best := -1
+	for k, v := range channels {
+		if score := matchScore(v.Scheme, v.Cmd, message); score > best {
+			found = &channels[k]
+			best = score
+		}
+	}
+	return found
+}
+
+//-1 if message does not match, scheme is more specific than cmd
+func matchScore(scheme string, cmd string, message *IntercomMessage) int {
+	if len(scheme) > 0 && !strings.EqualFold(scheme, message.Scheme) {
+		return -1
+	}
+	if len(cmd) > 0 && !strings.EqualFold(cmd, message.Cmd) {
+		return -1
+	}
+	score := 0
+	if len(scheme) > 0 {
+		score += 2
+	}
+	if len(cmd) > 0 {
+		score += 1
+	}
+	return score
+}
+
+func newVendorClient() *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+	}
+}
+
+//intercom message as the custom payload which mobile parses
+func createIntercomContent(message *IntercomMessage) string {
+	data, _ := json.Marshal(message)
+	return string(data)
+}
+
+func postJson(client *http.Client, address string, header map[string]string, v interface{}) (int, []byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0, nil, err
+	}
+	req, err := http.NewRequest("POST", address, bytes.NewBuffer(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json;charset=utf-8")
+	return doRequest(client, req, header)
+}
+
+func postForm(client *http.Client, address string, header map[string]string, params url.Values) (int, []byte, error) {
+	req, err := http.NewRequest("POST", address, bytes.NewBuffer([]byte(params.Encode())))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=utf-8")
+	return doRequest(client, req, header)
+}
+
+func doRequest(client *http.Client, req *http.Request, header map[string]string) (int, []byte, error) {
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
@@ -0,0 +1,157 @@
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"jingxi.cn/transitservice/conf"
+	"jingxi.cn/transitservice/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//https://dev.vivo.com.cn/documentCenter/doc/362
+
+const (
+	ProviderVivo = "vivo"
+
+	vivoPushUrl       = "https://api-push.vivo.com.cn"
+	vivoTokenLifetime = 24 * time.Hour
+
+	vivoInvalidAuthToken = 10000
+	vivoMinTtl           = 60
+
+	vivoNotifyNone        = 1
+	vivoNotifyRingVibrate = 4
+)
+
+//https://dev.vivo.com.cn/documentCenter/doc/364
+var vivoInvalidTokenCodes = map[int]bool{
+	10302: true, //regId not exist
+	10303: true, //regId invalid
+}
+
+type VivoMessage struct {
+	RegId           string            `json:"regId"`
+	NotifyType      int               `json:"notifyType"` //1: none, 2: ring, 3: vibrate, 4: ring and vibrate
+	Title           string            `json:"title"`
+	Content         string            `json:"content"`
+	SkipType        int               `json:"skipType"`       //1: open app
+	Classification  int               `json:"classification"` //0: operation, 1: system message
+	Category        string            `json:"category,omitempty"`
+	TimeToLive      int               `json:"timeToLive,omitempty"` //seconds, at least 60
+	RequestId       string            `json:"requestId"`
+	ClientCustomMap map[string]string `json:"clientCustomMap,omitempty"`
+}
+
+type vivoResponse struct {
+	Result    int    `json:"result"`
+	Desc      string `json:"desc"`
+	TaskId    string `json:"taskId"`
+	AuthToken string `json:"authToken"`
+}
+
+type VivoProvider struct {
+	conf   conf.VendorPush
+	client *http.Client
+	token  tokenCache //authToken, valid one day
+}
+
+func NewVivoProvider(c conf.VendorPush) *VivoProvider {
+	if len(c.Url) < 1 {
+		c.Url = vivoPushUrl
+	}
+	if len(c.AuthUrl) < 1 {
+		c.AuthUrl = c.Url + "/message/auth"
+	}
+	return &VivoProvider{
+		conf:   c,
+		client: newVendorClient(),
+	}
+}
+
+func (p *VivoProvider) Name() string {
+	return ProviderVivo
+}
+
+//sign: md5(appId + appKey + timestamp + appSecret)
+func (p *VivoProvider) authToken() (string, error) {
+	return p.token.get(func() (string, time.Duration, error) {
+		timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+		ts := strconv.FormatInt(timestamp, 10)
+		status, body, err := postJson(p.client, p.conf.AuthUrl, nil, map[string]interface{}{
+			"appId":     p.conf.AppId,
+			"appKey":    p.conf.AppKey,
+			"timestamp": timestamp,
+			"sign":      utils.Md5String(p.conf.AppId + p.conf.AppKey + ts + p.conf.AppSecret),
+		})
+		if err != nil {
+			return "", 0, err
+		}
+		var r vivoResponse
+		if json.Unmarshal(body, &r) != nil || r.Result != 0 || len(r.AuthToken) < 1 {
+			return "", 0, fmt.Errorf("vivo auth token error(%d): %s", status, string(body))
+		}
+		return r.AuthToken, vivoTokenLifetime, nil
+	})
+}
+
+func (p *VivoProvider) createMessage(message *IntercomMessage) VivoMessage {
+	m := VivoMessage{
+		RegId:          message.Device,
+		NotifyType:     vivoNotifyRingVibrate,
+		Title:          message.Title,
+		Content:        message.Body,
+		SkipType:       1,
+		Classification: 1,
+		RequestId:      utils.RandString(32),
+		ClientCustomMap: map[string]string{
+			"intercomContent": createIntercomContent(message),
+		},
+	}
+	if message.Ttl > 0 {
+		m.TimeToLive = message.Ttl
+		if m.TimeToLive < vivoMinTtl {
+			m.TimeToLive = vivoMinTtl
+		}
+	}
+	if channel := matchChannel(p.conf.Channels, message); channel != nil {
+		m.Category = channel.Category
+	}
+	//do-not-disturb
+	if message.Silent {
+		m.NotifyType = vivoNotifyNone
+	}
+	return m
+}
+
+func (p *VivoProvider) Push(message *IntercomMessage) (*DeliveryResult, error) {
+	token, err := p.authToken()
+	if err != nil {
+		return nil, err
+	}
+	status, body, err := postJson(p.client, p.conf.Url+"/message/send",
+		map[string]string{"authToken": token}, p.createMessage(message))
+	if err != nil {
+		return nil, err
+	}
+	var r vivoResponse
+	if err = json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("invalid vivo response(%d): %s", status, string(body))
+	}
+	result := &DeliveryResult{
+		Provider:     ProviderVivo,
+		Success:      r.Result == 0,
+		Code:         r.Result,
+		Reason:       r.Desc,
+		InvalidToken: vivoInvalidTokenCodes[r.Result],
+		Raw:          string(body),
+	}
+	if r.Result == vivoInvalidAuthToken {
+		p.token.reset()
+		result.Retryable = true
+	} else if !result.Success {
+		result.Retryable = status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+	}
+	return result, nil
+}
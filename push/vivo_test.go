@@ -0,0 +1,77 @@
+package push
+
+import (
+	"encoding/json"
+	"jingxi.cn/transitservice/conf"
+	"net/http"
+	"testing"
+)
+
+const (
+	vivoTestSend = "/message/send"
+	vivoTestAuth = "/message/auth"
+)
+
+var vivoTestAuthReply = map[string]fakeReply{
+	vivoTestAuth: {status: http.StatusOK, body: `{"result":0,"desc":"success","authToken":"auth-1"}`},
+}
+
+func newTestVivoProvider(serverUrl string) *VivoProvider {
+	return NewVivoProvider(conf.VendorPush{
+		Url:       serverUrl,
+		AppId:     "app-1",
+		AppKey:    "app-key",
+		AppSecret: "secret",
+		Channels: []conf.PushChannel{
+			{Scheme: "call", Category: "IM"},
+		},
+	})
+}
+
+func TestVivoPush(t *testing.T) {
+	runResultCases(t, ProviderVivo, vivoTestSend, vivoTestAuthReply, []resultCase{
+		{"success", fakeReply{status: http.StatusOK, body: `{"result":0,"desc":"success","taskId":"1"}`},
+			wantResult{success: true}},
+		{"regid not exist", fakeReply{status: http.StatusOK, body: `{"result":10302,"desc":"regId not exist"}`},
+			wantResult{invalidToken: true}},
+		{"server error", fakeReply{status: http.StatusInternalServerError, body: `{"result":10500,"desc":"server error"}`},
+			wantResult{retryable: true}},
+		{"invalid auth token", fakeReply{status: http.StatusOK, body: `{"result":10000,"desc":"authToken invalid"}`},
+			wantResult{retryable: true}},
+		{"unparsable body", fakeReply{status: http.StatusBadGateway, body: `<html>bad gateway</html>`},
+			wantResult{err: true}},
+	}, func(serverUrl string) PushProvider {
+		return newTestVivoProvider(serverUrl)
+	})
+}
+
+func TestVivoRequest(t *testing.T) {
+	f := newFakePush(t, map[string]fakeReply{
+		vivoTestAuth: vivoTestAuthReply[vivoTestAuth],
+		vivoTestSend: {status: http.StatusOK, body: `{"result":0}`},
+	})
+	message := newTestMessage()
+	message.Ttl = 10
+	if _, err := newTestVivoProvider(f.URL).Push(message); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	request := f.received(vivoTestSend)[0]
+	if request.Header.Get("authToken") != "auth-1" {
+		t.Errorf("authToken %s", request.Header.Get("authToken"))
+	}
+	var m VivoMessage
+	if err := json.Unmarshal([]byte(request.Body), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.RegId != "token-1" || m.Category != "IM" || m.TimeToLive != vivoMinTtl {
+		t.Errorf("message %+v", m)
+	}
+}
+
+func TestVivoSilent(t *testing.T) {
+	message := newTestMessage()
+	message.Silent = true
+	if m := newTestVivoProvider("").createMessage(message); m.NotifyType != vivoNotifyNone {
+		t.Errorf("notifyType %d, want none", m.NotifyType)
+	}
+}
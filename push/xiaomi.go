@@ -0,0 +1,105 @@
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"jingxi.cn/transitservice/conf"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+//https://dev.mi.com/distribute/doc/details?pId=1163
+//MiPush authenticates every request with the app secret, there is no token to refresh
+
+const (
+	ProviderXiaomi = "xiaomi"
+
+	xiaomiPushUrl = "https://api.xmpush.xiaomi.com"
+
+	xiaomiNotifyAll    = "-1" //DEFAULT_ALL: sound, vibration and lights
+	xiaomiNotifyLights = "4"  //DEFAULT_LIGHTS only, no sound or vibration
+)
+
+//https://dev.mi.com/distribute/doc/details?pId=1556
+var xiaomiInvalidTokenCodes = map[int]bool{
+	20301: true, //invalid regId
+	20307: true, //regId not registered
+}
+
+type xiaomiResponse struct {
+	Result      string `json:"result"`
+	Code        int    `json:"code"`
+	Description string `json:"description"`
+	Reason      string `json:"reason"`
+}
+
+type XiaomiProvider struct {
+	conf   conf.VendorPush
+	client *http.Client
+}
+
+func NewXiaomiProvider(c conf.VendorPush) *XiaomiProvider {
+	if len(c.Url) < 1 {
+		c.Url = xiaomiPushUrl
+	}
+	return &XiaomiProvider{
+		conf:   c,
+		client: newVendorClient(),
+	}
+}
+
+func (p *XiaomiProvider) Name() string {
+	return ProviderXiaomi
+}
+
+func (p *XiaomiProvider) createParams(message *IntercomMessage) url.Values {
+	params := url.Values{}
+	params.Add("registration_id", message.Device)
+	params.Add("restricted_package_name", p.conf.Package)
+	params.Add("title", message.Title)
+	params.Add("description", message.Body)
+	params.Add("payload", createIntercomContent(message))
+	params.Add("pass_through", "0")
+	params.Add("extra.notify_effect", "1")
+	if message.Ttl > 0 {
+		params.Add("time_to_live", strconv.Itoa(message.Ttl*1000)) //milliseconds
+	}
+	//do-not-disturb, channel of calls rings so it is not used
+	if message.Silent {
+		params.Add("notify_type", xiaomiNotifyLights)
+		return params
+	}
+	params.Add("notify_type", xiaomiNotifyAll)
+	//xiaomi classifies message by channel, calls use the private message channel
+	if channel := matchChannel(p.conf.Channels, message); channel != nil && len(channel.ChannelId) > 0 {
+		params.Add("extra.channel_id", channel.ChannelId)
+	}
+	return params
+}
+
+func (p *XiaomiProvider) Push(message *IntercomMessage) (*DeliveryResult, error) {
+	status, body, err := postForm(p.client, p.conf.Url+"/v3/message/regid",
+		map[string]string{"Authorization": "key=" + p.conf.AppSecret},
+		p.createParams(message))
+	if err != nil {
+		return nil, err
+	}
+	var r xiaomiResponse
+	if err = json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("invalid xiaomi response(%d): %s", status, string(body))
+	}
+	reason := r.Reason
+	if len(reason) < 1 {
+		reason = r.Description
+	}
+	return &DeliveryResult{
+		Provider:     ProviderXiaomi,
+		Success:      r.Result == "ok" && r.Code == 0,
+		Code:         r.Code,
+		Reason:       reason,
+		Retryable:    status == http.StatusTooManyRequests || status >= http.StatusInternalServerError,
+		InvalidToken: xiaomiInvalidTokenCodes[r.Code],
+		Raw:          string(body),
+	}, nil
+}
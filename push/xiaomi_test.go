@@ -0,0 +1,64 @@
+package push
+
+import (
+	"jingxi.cn/transitservice/conf"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+const xiaomiTestSend = "/v3/message/regid"
+
+func newTestXiaomiProvider(serverUrl string) *XiaomiProvider {
+	return NewXiaomiProvider(conf.VendorPush{
+		Url:       serverUrl,
+		AppSecret: "secret",
+		Package:   "com.example.app",
+		Channels: []conf.PushChannel{
+			{Scheme: "call", ChannelId: "calls"},
+		},
+	})
+}
+
+func TestXiaomiPush(t *testing.T) {
+	runResultCases(t, ProviderXiaomi, xiaomiTestSend, nil, []resultCase{
+		{"success", fakeReply{status: http.StatusOK, body: `{"result":"ok","code":0,"data":{"id":"1"}}`},
+			wantResult{success: true}},
+		{"invalid regid", fakeReply{status: http.StatusOK, body: `{"result":"error","code":20301,"reason":"invalid regId"}`},
+			wantResult{invalidToken: true}},
+		{"server error", fakeReply{status: http.StatusServiceUnavailable, body: `{"result":"error","code":10001,"reason":"busy"}`},
+			wantResult{retryable: true}},
+		{"unparsable body", fakeReply{status: http.StatusBadGateway, body: `<html>bad gateway</html>`},
+			wantResult{err: true}},
+	}, func(serverUrl string) PushProvider {
+		return newTestXiaomiProvider(serverUrl)
+	})
+}
+
+func TestXiaomiRequest(t *testing.T) {
+	f := newFakePush(t, map[string]fakeReply{xiaomiTestSend: {status: http.StatusOK, body: `{"result":"ok","code":0}`}})
+	if _, err := newTestXiaomiProvider(f.URL).Push(newTestMessage()); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	request := f.received(xiaomiTestSend)[0]
+	if request.Header.Get("Authorization") != "key=secret" {
+		t.Errorf("authorization %s", request.Header.Get("Authorization"))
+	}
+	params, err := url.ParseQuery(request.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Get("registration_id") != "token-1" || params.Get("restricted_package_name") != "com.example.app" ||
+		params.Get("extra.channel_id") != "calls" {
+		t.Errorf("params %v", params)
+	}
+}
+
+func TestXiaomiSilent(t *testing.T) {
+	message := newTestMessage()
+	message.Silent = true
+	params := newTestXiaomiProvider("").createParams(message)
+	if params.Get("notify_type") != xiaomiNotifyLights || len(params.Get("extra.channel_id")) > 0 {
+		t.Errorf("params %v, want lights only without channel", params)
+	}
+}
@@ -1,6 +1,20 @@
 package push
 
-import "encoding/json"
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"jingxi.cn/transitservice/conf"
+	"jingxi.cn/transitservice/utils"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
 
 //https://doc.yunxin.163.com/messaging/docs/jYxMjQ1NTk?platform=server
 
@@ -18,7 +32,8 @@ type Alert struct {
 //https://faq.yunxin.163.com/kb/main/#/item/0198
 type ApsField struct {
 	MutableContent int    `json:"mutable-content"`
-	Sound          string `json:"sound"`
+	Sound          string `json:"sound,omitempty"` //empty is silent
+	Category       string `json:"category,omitempty"`
 	AlertInfo      Alert  `json:"alert"`
 }
 
@@ -40,17 +55,30 @@ func CreateAttach(msgTag string, message *IntercomMessage) ([]byte, error) {
 	return data, nil
 }
 
+//apsField is the aps dictionary of APNs
+func CreateApsField(message *IntercomMessage) ApsField {
+	aps := ApsField{
+		MutableContent: 1,
+		Sound:          "default",
+		AlertInfo: Alert{
+			Title: message.Title,
+			Body:  message.Body,
+		},
+	}
+	if len(message.Sound) > 0 {
+		aps.Sound = message.Sound
+	}
+	if message.Silent {
+		aps.Sound = ""
+	}
+	aps.Category = message.Category
+	return aps
+}
+
 func CreatePayload(message *IntercomMessage) ([]byte, error) {
 	payload := Payload{
 		PushTitle: message.Title,
-		Aps: ApsField{
-			MutableContent: 1,
-			Sound:          "default",
-			AlertInfo: Alert{
-				Title: message.Title,
-				Body:  message.Body,
-			},
-		},
+		Aps:       CreateApsField(message),
 	}
 	data, err := json.Marshal(payload)
 	if err != nil {
@@ -58,3 +86,255 @@ func CreatePayload(message *IntercomMessage) ([]byte, error) {
 	}
 	return data, nil
 }
+
+const ProviderYunxin = "yunxin"
+
+//NetEase Yunxin custom system notification
+type YunxinProvider struct {
+	serverConf *conf.ServerConfig
+	client     *http.Client
+}
+
+func NewYunxinProvider(conf *conf.ServerConfig) *YunxinProvider {
+	return &YunxinProvider{
+		serverConf: conf,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+func (p *YunxinProvider) Name() string {
+	return ProviderYunxin
+}
+
+//attach and payload posted to yunxin
+func (p *YunxinProvider) Render(message *IntercomMessage) (map[string]string, error) {
+	attachBytes, err := CreateAttach(p.serverConf.Push.MsgTag, message)
+	if err != nil {
+		return nil, err
+	}
+	payloadBytes, err := CreatePayload(message)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"attach":  string(attachBytes),
+		"payload": string(payloadBytes),
+	}, nil
+}
+
+//remove tail char '_'
+func getAccount(pushId string) string {
+	for i := len(pushId) - 1; i >= 0; i-- {
+		if pushId[i] == '_' {
+			return pushId[:i]
+		}
+	}
+	return pushId
+}
+
+//https://doc.yunxin.163.com/messaging/docs/jYxMjQ1NTk?platform=server
+func (p *YunxinProvider) Push(message *IntercomMessage) (*DeliveryResult, error) {
+	content, err := p.Render(message)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Add("attach", content["attach"])
+	params.Add("pushcontent", message.Body)
+	params.Add("payload", content["payload"])
+	params.Add("msgtype", "0") //0：点对点自定义通知
+	params.Add("from", p.serverConf.Push.AppAccid)
+	params.Add("to", getAccount(message.Device))
+
+	if len(p.serverConf.Push.Save) > 0 {
+		params.Add("save", p.serverConf.Push.Save)
+	}
+
+	body, err := p.post(p.serverConf.Push.SendAttachMsgUrl, params)
+	if err != nil {
+		return nil, err
+	}
+	return parseYunxinResult(body)
+}
+
+//sendBatchAttachMsg accepts 500 accounts per request
+const yunxinBatchSize = 500
+
+func (p *YunxinProvider) batchUrl() string {
+	if len(p.serverConf.Push.SendBatchUrl) > 0 {
+		return p.serverConf.Push.SendBatchUrl
+	}
+	return strings.Replace(p.serverConf.Push.SendAttachMsgUrl, "sendAttachMsg", "sendBatchAttachMsg", 1)
+}
+
+//https://doc.yunxin.163.com/messaging/docs/jYxMjQ1NTk?platform=server
+//attach is rendered once, device and user of its intercom content are empty
+//accounts are sent 500 per request, accounts of a failed request get retryable results
+func (p *YunxinProvider) PushBatch(messages []*IntercomMessage) ([]*DeliveryResult, error) {
+	if len(messages) < 1 {
+		return nil, nil
+	}
+	message := *messages[0]
+	message.Device = ""
+	message.User = ""
+	content, err := p.Render(&message)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*DeliveryResult, 0, len(messages))
+	for start := 0; start < len(messages); start += yunxinBatchSize {
+		end := start + yunxinBatchSize
+		if end > len(messages) {
+			end = len(messages)
+		}
+		accids := make([]string, 0, end-start)
+		for _, m := range messages[start:end] {
+			accids = append(accids, getAccount(m.Device))
+		}
+		toAccids, _ := json.Marshal(accids)
+		params := url.Values{}
+		params.Add("fromAccid", p.serverConf.Push.AppAccid)
+		params.Add("toAccids", string(toAccids))
+		params.Add("attach", content["attach"])
+		params.Add("pushcontent", message.Body)
+		params.Add("payload", content["payload"])
+		if len(p.serverConf.Push.Save) > 0 {
+			params.Add("save", p.serverConf.Push.Save)
+		}
+		body, err := p.post(p.batchUrl(), params)
+		var batchResults []*DeliveryResult
+		if err == nil {
+			batchResults, err = parseYunxinBatchResult(body, accids)
+		}
+		if err != nil {
+			//accounts of other requests got or may get the message, only this request is retried
+			logrus.Errorf("batch push to %d accounts error: %+v", len(accids), err)
+			batchResults = make([]*DeliveryResult, 0, len(accids))
+			for range accids {
+				batchResults = append(batchResults, &DeliveryResult{
+					Provider:  ProviderYunxin,
+					Reason:    err.Error(),
+					Retryable: true,
+				})
+			}
+		}
+		results = append(results, batchResults...)
+	}
+	return results, nil
+}
+
+func (p *YunxinProvider) post(address string, params url.Values) ([]byte, error) {
+	req, err := http.NewRequest("POST", address, bytes.NewBuffer([]byte(params.Encode())))
+	if err != nil {
+		return nil, err
+	}
+	p.addHeader(req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		logrus.Errorf("Request(%+v) error: %+v", params, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+//https://doc.yunxin.163.com/messaging/docs/jYxMjQ1NTk?platform=server
+//code: 414,403,500
+type YunxinResult struct {
+	Code int    `json:"code"`
+	Desc string `json:"desc"`
+}
+
+func parseYunxinResult(body []byte) (*DeliveryResult, error) {
+	var r YunxinResult
+	err := json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, err
+	}
+	return yunxinResult(r.Code, r.Desc, body), nil
+}
+
+//403 forbidden and 414 bad parameter never succeed by retry, 404 is unknown account
+//single and batch pushes classify codes the same
+func yunxinResult(code int, desc string, body []byte) *DeliveryResult {
+	return &DeliveryResult{
+		Provider:     ProviderYunxin,
+		Success:      code == http.StatusOK,
+		Code:         code,
+		Reason:       desc,
+		Retryable:    code != http.StatusOK && code != 403 && code != 404 && code != 414,
+		InvalidToken: code == 404,
+		Raw:          string(body),
+	}
+}
+
+//unregister lists accounts not found, it is a json array or a string of json array
+type YunxinBatchResult struct {
+	Code       int             `json:"code"`
+	Desc       string          `json:"desc"`
+	Unregister json.RawMessage `json:"unregister"`
+}
+
+//one result per account, unregistered accounts fail as unknown account
+func parseYunxinBatchResult(body []byte, accids []string) ([]*DeliveryResult, error) {
+	var r YunxinBatchResult
+	err := json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, err
+	}
+	unregister := make(map[string]bool)
+	if len(r.Unregister) > 0 {
+		data := []byte(r.Unregister)
+		var s string
+		if json.Unmarshal(data, &s) == nil {
+			data = []byte(s)
+		}
+		var accounts []string
+		if json.Unmarshal(data, &accounts) == nil {
+			for _, v := range accounts {
+				unregister[v] = true
+			}
+		}
+	}
+	results := make([]*DeliveryResult, 0, len(accids))
+	for _, v := range accids {
+		if r.Code == http.StatusOK && unregister[v] {
+			results = append(results, &DeliveryResult{
+				Provider:     ProviderYunxin,
+				Code:         404,
+				Reason:       "unregistered account",
+				InvalidToken: true,
+				Raw:          string(body),
+			})
+			continue
+		}
+		results = append(results, yunxinResult(r.Code, r.Desc, body))
+	}
+	return results, nil
+}
+
+//https://doc.yunxin.163.com/TM5MzM5Njk/docs/jk3MzY2MTI?platform=server
+func (p *YunxinProvider) addHeader(req *http.Request) {
+	nonce := utils.RandString(16)
+	curTime := strconv.FormatInt(time.Now().Unix(), 10)
+	chechSum := checkSum(p.serverConf.Push.AppSecret, nonce, curTime)
+	req.Header.Add("AppKey", p.serverConf.Push.AppKey)
+	req.Header.Add("Nonce", nonce)
+	req.Header.Add("CurTime", curTime)
+	req.Header.Add("CheckSum", chechSum)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded;charset=utf-8")
+}
+
+//SHA1(AppSecret + Nonce + CurTime)
+func checkSum(a string, b string, c string) string {
+	var builder strings.Builder
+	builder.WriteString(a)
+	builder.WriteString(b)
+	builder.WriteString(c)
+	o := sha1.New()
+	o.Write([]byte(builder.String()))
+	return hex.EncodeToString(o.Sum(nil))
+}
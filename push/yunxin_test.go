@@ -0,0 +1,227 @@
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"jingxi.cn/transitservice/conf"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	yunxinTestSend  = "/nimserver/msg/sendAttachMsg.action"
+	yunxinTestBatch = "/nimserver/msg/sendBatchAttachMsg.action"
+)
+
+func newTestYunxinConf(serverUrl string) *conf.ServerConfig {
+	c := &conf.ServerConfig{}
+	c.Push.AppKey = "app-key"
+	c.Push.AppSecret = "app-secret"
+	c.Push.AppAccid = "door"
+	c.Push.MsgTag = "intercom"
+	c.Push.SendAttachMsgUrl = serverUrl + yunxinTestSend
+	return c
+}
+
+func TestYunxinPush(t *testing.T) {
+	runResultCases(t, ProviderYunxin, yunxinTestSend, nil, []resultCase{
+		{"success", fakeReply{status: http.StatusOK, body: `{"code":200}`},
+			wantResult{success: true}},
+		{"unknown account", fakeReply{status: http.StatusOK, body: `{"code":404,"desc":"account not found"}`},
+			wantResult{invalidToken: true}},
+		{"server error", fakeReply{status: http.StatusOK, body: `{"code":500,"desc":"server busy"}`},
+			wantResult{retryable: true}},
+		{"bad parameter", fakeReply{status: http.StatusOK, body: `{"code":414,"desc":"parameter error"}`},
+			wantResult{}},
+		{"unparsable body", fakeReply{status: http.StatusBadGateway, body: `<html>bad gateway</html>`},
+			wantResult{err: true}},
+	}, func(serverUrl string) PushProvider {
+		return NewYunxinProvider(newTestYunxinConf(serverUrl))
+	})
+}
+
+func TestYunxinRequest(t *testing.T) {
+	f := newFakePush(t, map[string]fakeReply{yunxinTestSend: {status: http.StatusOK, body: `{"code":200}`}})
+	if _, err := NewYunxinProvider(newTestYunxinConf(f.URL)).Push(newTestMessage()); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	request := f.received(yunxinTestSend)[0]
+	header := request.Header
+	if header.Get("AppKey") != "app-key" ||
+		header.Get("CheckSum") != checkSum("app-secret", header.Get("Nonce"), header.Get("CurTime")) {
+		t.Errorf("auth headers %v", header)
+	}
+	params, err := url.ParseQuery(request.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Get("from") != "door" || params.Get("to") != "token-1" || params.Get("msgtype") != "0" {
+		t.Errorf("params %v", params)
+	}
+	var attach Attach
+	if err = json.Unmarshal([]byte(params.Get("attach")), &attach); err != nil {
+		t.Fatal(err)
+	}
+	if attach.Type != "intercom" || attach.IntercomContent.Cid != "cid-1" {
+		t.Errorf("attach %+v", attach)
+	}
+}
+
+func TestYunxinPushBatch(t *testing.T) {
+	f := newFakePush(t, map[string]fakeReply{yunxinTestBatch: {
+		status: http.StatusOK,
+		body:   `{"code":200,"unregister":"[\"token-2\"]"}`,
+	}})
+	messages := []*IntercomMessage{newTestMessage(), newTestMessage()}
+	messages[1].Device = "token-2"
+	results, err := NewYunxinProvider(newTestYunxinConf(f.URL)).PushBatch(messages)
+	if err != nil {
+		t.Fatalf("PushBatch: %v", err)
+	}
+	if len(results) != 2 || !results[0].Success || results[1].Success || !results[1].InvalidToken {
+		t.Errorf("results %+v %+v, want success and unregistered", results[0], results[1])
+	}
+	params, err := url.ParseQuery(f.received(yunxinTestBatch)[0].Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Get("fromAccid") != "door" || params.Get("toAccids") != `["token-1","token-2"]` {
+		t.Errorf("params %v", params)
+	}
+}
+
+func TestYunxinPushBatchServerError(t *testing.T) {
+	f := newFakePush(t, map[string]fakeReply{yunxinTestBatch: {status: http.StatusOK, body: `{"code":500}`}})
+	results, err := NewYunxinProvider(newTestYunxinConf(f.URL)).PushBatch([]*IntercomMessage{newTestMessage()})
+	if err != nil {
+		t.Fatalf("PushBatch: %v", err)
+	}
+	if results[0].Success || !results[0].Retryable {
+		t.Errorf("result %+v, want retryable", results[0])
+	}
+}
+
+func TestYunxinPushBatchPartialFailure(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) > 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte(`<html>bad gateway</html>`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"code":200}`))
+	}))
+	defer server.Close()
+	messages := make([]*IntercomMessage, yunxinBatchSize+1)
+	for k := range messages {
+		messages[k] = newTestMessage()
+		messages[k].Device = fmt.Sprintf("token-%d", k)
+	}
+	results, err := NewYunxinProvider(newTestYunxinConf(server.URL)).PushBatch(messages)
+	if err != nil {
+		t.Fatalf("PushBatch: %v", err)
+	}
+	if len(results) != len(messages) {
+		t.Fatalf("%d results, want %d", len(results), len(messages))
+	}
+	if !results[0].Success || !results[yunxinBatchSize-1].Success {
+		t.Errorf("results of the first request %+v, want success", results[0])
+	}
+	if last := results[yunxinBatchSize]; last.Success || !last.Retryable {
+		t.Errorf("result of the failed request %+v, want retryable", last)
+	}
+}
+
+func TestPushAllBatchesByContent(t *testing.T) {
+	f := newFakePush(t, map[string]fakeReply{yunxinTestBatch: {status: http.StatusOK, body: `{"code":200}`}})
+	c := newTestYunxinConf(f.URL)
+	service := &PushService{serverConf: c, providers: make(map[string]PushProvider)}
+	service.AddProvider(NewYunxinProvider(c))
+	messages := make([]*IntercomMessage, 3)
+	for k := range messages {
+		messages[k] = newTestMessage()
+		messages[k].Device = fmt.Sprintf("token-%d", k)
+	}
+	messages[2].Locale = "en"
+	messages[2].Title = "Visitor"
+	for k, result := range service.PushAll(messages) {
+		if !result.Success || result.Target != messages[k].Device {
+			t.Errorf("result %+v of %s", result, messages[k].Device)
+		}
+	}
+	requests := f.received(yunxinTestBatch)
+	if len(requests) != 2 {
+		t.Fatalf("%d batch requests, want one per content", len(requests))
+	}
+	for _, request := range requests {
+		params, err := url.ParseQuery(request.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var attach Attach
+		if err = json.Unmarshal([]byte(params.Get("attach")), &attach); err != nil {
+			t.Fatal(err)
+		}
+		english := params.Get("toAccids") == `["token-2"]`
+		if english != (attach.IntercomContent.Title == "Visitor") {
+			t.Errorf("accounts %s got title %s", params.Get("toAccids"), attach.IntercomContent.Title)
+		}
+	}
+}
+
+func TestYunxinPushBatchUnknownAccount(t *testing.T) {
+	body := `{"code":404,"desc":"account not found"}`
+	f := newFakePush(t, map[string]fakeReply{
+		yunxinTestSend:  {status: http.StatusOK, body: body},
+		yunxinTestBatch: {status: http.StatusOK, body: body},
+	})
+	provider := NewYunxinProvider(newTestYunxinConf(f.URL))
+	single, err := provider.Push(newTestMessage())
+	if err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	results, err := provider.PushBatch([]*IntercomMessage{newTestMessage()})
+	if err != nil {
+		t.Fatalf("PushBatch: %v", err)
+	}
+	batch := results[0]
+	if batch.Retryable != single.Retryable || batch.InvalidToken != single.InvalidToken || batch.Retryable {
+		t.Errorf("batch result %+v, want the same as single %+v", batch, single)
+	}
+}
+
+func TestPushAllBatchesFamilyResidents(t *testing.T) {
+	f := newFakePush(t, map[string]fakeReply{yunxinTestBatch: {status: http.StatusOK, body: `{"code":200}`}})
+	c := newTestYunxinConf(f.URL)
+	service := &PushService{serverConf: c, providers: make(map[string]PushProvider)}
+	service.AddProvider(NewYunxinProvider(c))
+	messages := make([]*IntercomMessage, 3)
+	for k := range messages {
+		messages[k] = newTestMessage()
+		messages[k].Device = fmt.Sprintf("token-%d", k)
+		messages[k].User = fmt.Sprintf("user-%d", k)
+	}
+	for _, result := range service.PushAll(messages) {
+		if !result.Success {
+			t.Errorf("result %+v", result)
+		}
+	}
+	requests := f.received(yunxinTestBatch)
+	if len(requests) != 1 {
+		t.Fatalf("%d batch requests, want one for the family", len(requests))
+	}
+	params, err := url.ParseQuery(requests[0].Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attach Attach
+	if err = json.Unmarshal([]byte(params.Get("attach")), &attach); err != nil {
+		t.Fatal(err)
+	}
+	if len(attach.IntercomContent.User) > 0 || len(attach.IntercomContent.Device) > 0 {
+		t.Errorf("intercom content %+v, want no user or device", attach.IntercomContent)
+	}
+}
@@ -0,0 +1,139 @@
+package registry
+
+import (
+	"github.com/sirupsen/logrus"
+	"jingxi.cn/transitservice/opensips"
+	"jingxi.cn/transitservice/utils"
+	"sync"
+	"time"
+)
+
+//intercom device which registered sip account by /opensip/v2/register
+type Device struct {
+	Username     string `json:"username"` //sip username
+	Did          string `json:"did"`
+	ClientId     string `json:"cid"`
+	FamilyId     string `json:"fid"`
+	Type         int    `json:"type"`
+	SubType      int    `json:"subType"`
+	ButtonKey    string `json:"buttonKey"`
+	AliasName    string `json:"aliasName"`
+	Platform     int    `json:"platform"`
+	Version      int    `json:"version"`
+	SerialNumber string `json:"sn"`
+	Number       string `json:"number"` //room number
+	Community    string `json:"community"`
+	Building     string `json:"building"`
+	Unit         string `json:"unit"`
+	UpdateTime   int64  `json:"updateTime"`
+}
+
+//devices keyed by sip username, persisted as a json file
+type DeviceRegistry struct {
+	file    string
+	devices map[string]*Device
+	rw      sync.RWMutex
+}
+
+func LoadDeviceRegistry(file string) (*DeviceRegistry, error) {
+	r := &DeviceRegistry{
+		file:    file,
+		devices: make(map[string]*Device),
+	}
+	var devices []*Device
+	_, err := utils.LoadJsonFile(file, &devices)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range devices {
+		r.devices[v.Username] = v
+	}
+	return r, nil
+}
+
+func NewDevice(username string, req *opensips.UserRequest) *Device {
+	return &Device{
+		Username:     username,
+		Did:          req.Did,
+		ClientId:     req.Client.ClientId,
+		FamilyId:     req.Client.FamilyId,
+		Type:         req.Client.Type,
+		SubType:      req.Client.SubType,
+		ButtonKey:    req.Client.ButtonKey,
+		AliasName:    req.Client.AliasName,
+		Platform:     req.Client.Platform,
+		Version:      req.Client.Version,
+		SerialNumber: req.Client.SerialNumber,
+		Number:       req.Client.Number,
+		Community:    req.Client.Community,
+		Building:     req.Client.Building,
+		Unit:         req.Client.Unit,
+		UpdateTime:   time.Now().Unix(),
+	}
+}
+
+//add or replace device, saved only when device info changed
+func (r *DeviceRegistry) Update(device *Device) error {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	if old, ok := r.devices[device.Username]; ok {
+		cmp := *device
+		cmp.UpdateTime = old.UpdateTime
+		if cmp == *old {
+			return nil
+		}
+	}
+	r.devices[device.Username] = device
+	return r.save()
+}
+
+//nil if not found, returned device is a copy
+func (r *DeviceRegistry) Get(username string) *Device {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+	if v, ok := r.devices[username]; ok {
+		device := *v
+		return &device
+	}
+	return nil
+}
+
+//copies of devices which filter returns true
+func (r *DeviceRegistry) Find(filter func(*Device) bool) []*Device {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+	var devices []*Device
+	for _, v := range r.devices {
+		if filter(v) {
+			device := *v
+			devices = append(devices, &device)
+		}
+	}
+	return devices
+}
+
+//device of intercom client id, nil if not found
+func (r *DeviceRegistry) FindByClientId(cid string) *Device {
+	if len(cid) < 1 {
+		return nil
+	}
+	devices := r.Find(func(d *Device) bool {
+		return d.ClientId == cid
+	})
+	if len(devices) < 1 {
+		return nil
+	}
+	return devices[0]
+}
+
+func (r *DeviceRegistry) save() error {
+	devices := make([]*Device, 0, len(r.devices))
+	for _, v := range r.devices {
+		devices = append(devices, v)
+	}
+	err := utils.SaveJsonFile(r.file, devices)
+	if err != nil {
+		logrus.Errorf("save device registry(%s) error: %+v", r.file, err)
+	}
+	return err
+}
@@ -0,0 +1,228 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"jingxi.cn/transitservice/utils"
+	"strings"
+	"sync"
+	"time"
+)
+
+//quiet time starting on weekdays, end before start spans midnight
+type DndRange struct {
+	Weekdays []int  `json:"weekdays"` //0 is Sunday, empty is every day
+	Start    string `json:"start"`    //HH:MM
+	End      string `json:"end"`      //HH:MM
+}
+
+//do-not-disturb schedule of a user or a family
+type DndSchedule struct {
+	Id         string     `json:"id"`
+	UserId     string     `json:"userId"`
+	FamilyId   string     `json:"fid"`
+	Timezone   string     `json:"timezone"` //IANA name, empty is local time of server
+	Ranges     []DndRange `json:"ranges"`
+	Exceptions []string   `json:"exceptions"` //schemes always delivered, e.g. emergency
+	Disabled   bool       `json:"disabled"`
+	CreateTime int64      `json:"createTime"`
+	UpdateTime int64      `json:"updateTime"`
+}
+
+//minutes of day
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s, HH:MM expected", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (s *DndSchedule) validate() error {
+	if len(s.UserId) < 1 && len(s.FamilyId) < 1 {
+		return errors.New("userId or fid is required")
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %s", s.Timezone)
+	}
+	if len(s.Ranges) < 1 {
+		return errors.New("ranges are required")
+	}
+	for _, r := range s.Ranges {
+		for _, d := range r.Weekdays {
+			if d < 0 || d > 6 {
+				return fmt.Errorf("invalid weekday %d, 0-6 expected", d)
+			}
+		}
+		if _, err := parseClock(r.Start); err != nil {
+			return err
+		}
+		if _, err := parseClock(r.End); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasWeekday(weekdays []int, day time.Weekday) bool {
+	if len(weekdays) < 1 {
+		return true
+	}
+	for _, v := range weekdays {
+		if v == int(day) {
+			return true
+		}
+	}
+	return false
+}
+
+//schedule is quiet at t
+func (s *DndSchedule) IsActive(t time.Time) bool {
+	if s.Disabled {
+		return false
+	}
+	location, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		location = time.Local
+	}
+	t = t.In(location)
+	now := t.Hour()*60 + t.Minute()
+	for _, r := range s.Ranges {
+		start, err1 := parseClock(r.Start)
+		end, err2 := parseClock(r.End)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		if start < end {
+			if hasWeekday(r.Weekdays, t.Weekday()) && now >= start && now < end {
+				return true
+			}
+			continue
+		}
+		//spans midnight, the part after midnight belongs to the range of yesterday
+		if hasWeekday(r.Weekdays, t.Weekday()) && now >= start {
+			return true
+		}
+		if hasWeekday(r.Weekdays, t.AddDate(0, 0, -1).Weekday()) && now < end {
+			return true
+		}
+	}
+	return false
+}
+
+//scheme is delivered even in quiet time
+func (s *DndSchedule) IsException(scheme string) bool {
+	for _, v := range s.Exceptions {
+		if strings.EqualFold(v, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+//do-not-disturb schedules keyed by id, persisted as a json file
+type DndRegistry struct {
+	file      string
+	schedules map[string]*DndSchedule
+	rw        sync.RWMutex
+}
+
+func LoadDndRegistry(file string) (*DndRegistry, error) {
+	r := &DndRegistry{
+		file:      file,
+		schedules: make(map[string]*DndSchedule),
+	}
+	var schedules []*DndSchedule
+	_, err := utils.LoadJsonFile(file, &schedules)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range schedules {
+		r.schedules[v.Id] = v
+	}
+	return r, nil
+}
+
+//add schedule when id is empty, otherwise replace it
+func (r *DndRegistry) Save(schedule *DndSchedule) error {
+	if err := schedule.validate(); err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	if len(schedule.Id) < 1 {
+		schedule.Id = utils.RandString(16)
+		schedule.CreateTime = now
+	} else if old, ok := r.schedules[schedule.Id]; ok {
+		schedule.CreateTime = old.CreateTime
+	} else {
+		return errors.New("schedule not found")
+	}
+	schedule.UpdateTime = now
+	r.schedules[schedule.Id] = schedule
+	return r.save()
+}
+
+func (r *DndRegistry) Delete(id string) error {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	if _, ok := r.schedules[id]; !ok {
+		return nil
+	}
+	delete(r.schedules, id)
+	return r.save()
+}
+
+//nil if not found, returned schedule is a copy
+func (r *DndRegistry) Get(id string) *DndSchedule {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+	if v, ok := r.schedules[id]; ok {
+		schedule := *v
+		return &schedule
+	}
+	return nil
+}
+
+//copies of schedules which filter returns true
+func (r *DndRegistry) Find(filter func(*DndSchedule) bool) []*DndSchedule {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+	var schedules []*DndSchedule
+	for _, v := range r.schedules {
+		if filter(v) {
+			schedule := *v
+			schedules = append(schedules, &schedule)
+		}
+	}
+	return schedules
+}
+
+//a schedule of user or family is quiet at t and scheme is not an exception
+func (r *DndRegistry) IsQuiet(userId string, fid string, scheme string, t time.Time) bool {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+	for _, v := range r.schedules {
+		if (len(v.UserId) > 0 && v.UserId == userId) || (len(v.UserId) < 1 && len(v.FamilyId) > 0 && v.FamilyId == fid) {
+			if v.IsActive(t) && !v.IsException(scheme) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *DndRegistry) save() error {
+	schedules := make([]*DndSchedule, 0, len(r.schedules))
+	for _, v := range r.schedules {
+		schedules = append(schedules, v)
+	}
+	err := utils.SaveJsonFile(r.file, schedules)
+	if err != nil {
+		logrus.Errorf("save dnd registry(%s) error: %+v", r.file, err)
+	}
+	return err
+}
@@ -0,0 +1,172 @@
+package registry
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"jingxi.cn/transitservice/utils"
+	"strings"
+	"sync"
+	"time"
+)
+
+//push identity of a mobile app install
+type PushToken struct {
+	Id            string `json:"id"`       //install id generated by app, unique per install
+	Provider      string `json:"provider"` //yunxin, apns, fcm, huawei, xiaomi, oppo, vivo
+	Token         string `json:"token"`    //device token, registration id or yunxin accid
+	Platform      int    `json:"platform"`
+	AppVersion    string `json:"appVersion"`
+	Locale        string `json:"locale"`
+	UserId        string `json:"userId"`
+	FamilyId      string `json:"fid"`
+	Invalid       bool   `json:"invalid"` //provider reported the token dead
+	InvalidReason string `json:"invalidReason,omitempty"`
+	CreateTime    int64  `json:"createTime"`
+	UpdateTime    int64  `json:"updateTime"`
+}
+
+//push tokens keyed by install id, persisted as a json file
+type TokenRegistry struct {
+	file   string
+	tokens map[string]*PushToken
+	rw     sync.RWMutex
+}
+
+func LoadTokenRegistry(file string) (*TokenRegistry, error) {
+	r := &TokenRegistry{
+		file:   file,
+		tokens: make(map[string]*PushToken),
+	}
+	var tokens []*PushToken
+	_, err := utils.LoadJsonFile(file, &tokens)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range tokens {
+		r.tokens[v.Id] = v
+	}
+	return r, nil
+}
+
+//add or replace token of install, a token moved to another install is removed from the old one
+func (r *TokenRegistry) Register(token *PushToken) error {
+	if len(token.Id) < 1 || len(token.Provider) < 1 || len(token.Token) < 1 {
+		return errors.New("id, provider and token are required")
+	}
+	token.Provider = strings.ToLower(token.Provider)
+	now := time.Now().Unix()
+
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	token.CreateTime = now
+	if old, ok := r.tokens[token.Id]; ok {
+		token.CreateTime = old.CreateTime
+	}
+	token.UpdateTime = now
+	token.Invalid = false
+	token.InvalidReason = ""
+	for k, v := range r.tokens {
+		if k != token.Id && v.Provider == token.Provider && v.Token == token.Token {
+			delete(r.tokens, k)
+		}
+	}
+	r.tokens[token.Id] = token
+	return r.save()
+}
+
+//provider issued a new token for the install
+func (r *TokenRegistry) Refresh(id string, token string) error {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	v, ok := r.tokens[id]
+	if !ok {
+		return errors.New("token not registered")
+	}
+	if len(token) > 0 {
+		v.Token = token
+	}
+	v.Invalid = false
+	v.InvalidReason = ""
+	v.UpdateTime = time.Now().Unix()
+	return r.save()
+}
+
+func (r *TokenRegistry) Unregister(id string) error {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	if _, ok := r.tokens[id]; !ok {
+		return nil
+	}
+	delete(r.tokens, id)
+	return r.save()
+}
+
+//provider reported token dead, it is not used until the app registers again
+func (r *TokenRegistry) Invalidate(provider string, token string, reason string) {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	changed := false
+	for _, v := range r.tokens {
+		if v.Provider == strings.ToLower(provider) && v.Token == token && !v.Invalid {
+			v.Invalid = true
+			v.InvalidReason = reason
+			v.UpdateTime = time.Now().Unix()
+			changed = true
+			logrus.Infof("push token(%s) of %s invalidated: %s", v.Id, v.Provider, reason)
+		}
+	}
+	if changed {
+		_ = r.save()
+	}
+}
+
+//nil if not found, returned token is a copy
+func (r *TokenRegistry) Get(id string) *PushToken {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+	if v, ok := r.tokens[id]; ok {
+		token := *v
+		return &token
+	}
+	return nil
+}
+
+//copies of tokens which filter returns true
+func (r *TokenRegistry) Find(filter func(*PushToken) bool) []*PushToken {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+	var tokens []*PushToken
+	for _, v := range r.tokens {
+		if filter(v) {
+			token := *v
+			tokens = append(tokens, &token)
+		}
+	}
+	return tokens
+}
+
+//valid tokens bound to user
+func (r *TokenRegistry) FindByUser(userId string) []*PushToken {
+	return r.Find(func(t *PushToken) bool {
+		return !t.Invalid && t.UserId == userId
+	})
+}
+
+//valid tokens of all residents of family
+func (r *TokenRegistry) FindByFamily(fid string) []*PushToken {
+	return r.Find(func(t *PushToken) bool {
+		return !t.Invalid && t.FamilyId == fid
+	})
+}
+
+func (r *TokenRegistry) save() error {
+	tokens := make([]*PushToken, 0, len(r.tokens))
+	for _, v := range r.tokens {
+		tokens = append(tokens, v)
+	}
+	err := utils.SaveJsonFile(r.file, tokens)
+	if err != nil {
+		logrus.Errorf("save token registry(%s) error: %+v", r.file, err)
+	}
+	return err
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrRevisionNotFound = errors.New("revision not found")
+
+//author of revisions taken from files edited on disk
+const FileAuthor = "file"
+
+//json content saved by an author, ids increase from 1
+type Revision struct {
+	Id         int             `json:"id"`
+	Author     string          `json:"author"`
+	Comment    string          `json:"comment"`
+	CreateTime int64           `json:"createTime"` //unix milliseconds
+	Content    json.RawMessage `json:"content,omitempty"`
+}
+
+//revisions stored as <dir>/<id>.json, dir may be shared by instances
+type RevisionStore struct {
+	dir string
+}
+
+func NewRevisionStore(dir string) *RevisionStore {
+	return &RevisionStore{dir: dir}
+}
+
+//ids of revisions, ascending
+func (s *RevisionStore) ids() ([]int, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(f.Name(), ".json"))
+		if err == nil && id > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (s *RevisionStore) path(id int) string {
+	return filepath.Join(s.dir, strconv.Itoa(id)+".json")
+}
+
+//save content as the next revision, a revision file is never overwritten
+func (s *RevisionStore) Add(author string, comment string, content []byte) (*Revision, error) {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, content); err != nil {
+		return nil, err
+	}
+	revision := &Revision{
+		Author:     author,
+		Comment:    comment,
+		CreateTime: time.Now().UnixNano() / int64(time.Millisecond),
+		Content:    compact.Bytes(),
+	}
+	err := os.MkdirAll(s.dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	tmp := filepath.Join(s.dir, RandString(16)+".tmp")
+	defer os.Remove(tmp)
+	for {
+		ids, err := s.ids()
+		if err != nil {
+			return nil, err
+		}
+		revision.Id = len(ids) + 1
+		if len(ids) > 0 {
+			revision.Id = ids[len(ids)-1] + 1
+		}
+		data, err := json.MarshalIndent(revision, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+		if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+			return nil, err
+		}
+		//link fails when another instance took the id
+		err = os.Link(tmp, s.path(revision.Id))
+		if err == nil {
+			return revision, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+	}
+}
+
+//nil if not found
+func (s *RevisionStore) Get(id int) (*Revision, error) {
+	var revision Revision
+	ok, err := LoadJsonFile(s.path(id), &revision)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+//nil if no revision saved
+func (s *RevisionStore) Latest() (*Revision, error) {
+	ids, err := s.ids()
+	if err != nil || len(ids) < 1 {
+		return nil, err
+	}
+	return s.Get(ids[len(ids)-1])
+}
+
+//oldest first, without content
+func (s *RevisionStore) List() ([]*Revision, error) {
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+	revisions := make([]*Revision, 0, len(ids))
+	for _, id := range ids {
+		revision, err := s.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if revision != nil {
+			revision.Content = nil
+			revisions = append(revisions, revision)
+		}
+	}
+	return revisions, nil
+}
@@ -2,24 +2,35 @@ package utils
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
 const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
-var seededRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+//rand.Rand is not safe for concurrent use, e.g. by push queue workers
+var (
+	seededRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	randMu     sync.Mutex
+)
 
 func RandString(n int) string {
 	b := make([]byte, n)
+	randMu.Lock()
 	for i := range b {
 		b[i] = letters[seededRand.Intn(len(letters))]
 	}
+	randMu.Unlock()
 	return string(b)
 }
 
@@ -29,6 +40,17 @@ func Md5String(str string) string {
 	return hex.EncodeToString(w.Sum(nil))
 }
 
+func Sha256String(str string) string {
+	sum := sha256.Sum256([]byte(str))
+	return hex.EncodeToString(sum[:])
+}
+
+//SHA-512/256 as defined in FIPS 180-4, not truncated SHA-512
+func Sha512t256String(str string) string {
+	sum := sha512.Sum512_256([]byte(str))
+	return hex.EncodeToString(sum[:])
+}
+
 func SaveAppStartTime(dir string) error {
 	t := fmt.Sprintf("%v\n", time.Now())
 	err := os.MkdirAll(filepath.Dir(dir), os.ModePerm)
@@ -46,3 +68,70 @@ func SaveAppStartTime(dir string) error {
 	}
 	return nil
 }
+
+//read json file into v, false if file does not exist
+func LoadJsonFile(file string, v interface{}) (bool, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+//write v to a temporary file and rename, so readers never see a half written file
+func SaveJsonFile(file string, v interface{}) error {
+	return saveJsonFile(file, v, false)
+}
+
+//SaveJsonFile which survives power loss, the file is synced before rename and its directory after
+func SyncJsonFile(file string, v interface{}) error {
+	return saveJsonFile(file, v, true)
+}
+
+func saveJsonFile(file string, v interface{}, sync bool) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, file)
+	if err != nil || !sync {
+		return err
+	}
+	return syncDir(filepath.Dir(file))
+}
+
+//rename is durable once the directory entry is synced
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}